@@ -0,0 +1,408 @@
+package endless
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+CertKeyPair names a certificate file and the file of its private key.
+*/
+type CertKeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+/*
+certStore holds the certificates of a TLS server. It is handed to the
+tls.Config as GetCertificate, so reloaded certificates are used for new
+handshakes right away.
+*/
+type certStore struct {
+	// the certificates to load, or the directory to find them in
+	pairs []CertKeyPair
+	dir   string
+
+	lock sync.RWMutex
+	set  *certSet
+	// the files the certificates were loaded from
+	loaded certStamp
+}
+
+/*
+certSet is a set of loaded certificates, indexed by the names they are valid
+for. The first one is the default for clients that send no or an unknown
+server name.
+*/
+type certSet struct {
+	pairs  []CertKeyPair
+	certs  []*tls.Certificate
+	byName map[string]*tls.Certificate
+}
+
+func newCertStore(pairs []CertKeyPair, dir string) (cs *certStore, err error) {
+	cs = &certStore{
+		pairs: pairs,
+		dir:   dir,
+	}
+	cs.set, cs.loaded, err = cs.load()
+	return
+}
+
+/*
+load loads all certificates. It fails if any of them can't be used. Expired
+certificates are loaded, see reload.
+*/
+func (cs *certStore) load() (set *certSet, stamp certStamp, err error) {
+	pairs, err := cs.currentPairs()
+	if err != nil {
+		return
+	}
+	stamp, _ = stampPairs(pairs)
+
+	set = &certSet{
+		byName: make(map[string]*tls.Certificate),
+	}
+	for _, pair := range pairs {
+		cert, err := loadCertificate(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return nil, "", err
+		}
+		set.add(pair, cert)
+	}
+	return
+}
+
+/*
+currentPairs returns the certificates to load. For a directory these are the
+files named like <name>.crt or <name>.pem with a <name>.key next to them,
+sorted by name but with default.crt (or default.pem) first.
+*/
+func (cs *certStore) currentPairs() ([]CertKeyPair, error) {
+	if cs.dir == "" {
+		return cs.pairs, nil
+	}
+
+	entries, err := os.ReadDir(cs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pairs []CertKeyPair
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".crt" && ext != ".pem") {
+			continue
+		}
+		base := strings.TrimSuffix(e.Name(), ext)
+		keyFile := filepath.Join(cs.dir, base+".key")
+		if _, err := os.Stat(keyFile); err != nil {
+			continue
+		}
+		pairs = append(pairs, CertKeyPair{filepath.Join(cs.dir, e.Name()), keyFile})
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", cs.dir)
+	}
+
+	isDefault := func(p CertKeyPair) bool {
+		return strings.TrimSuffix(filepath.Base(p.KeyFile), ".key") == "default"
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return isDefault(pairs[i]) && !isDefault(pairs[j])
+	})
+	return pairs, nil
+}
+
+/*
+loadCertificate loads a certificate and its key and makes sure the key matches.
+*/
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+func expired(cert *tls.Certificate) bool {
+	return time.Now().After(cert.Leaf.NotAfter)
+}
+
+/*
+add adds cert to the set under the DNS names of its certificate (or its common
+name if it has none). A name already taken by an earlier certificate is kept.
+*/
+func (set *certSet) add(pair CertKeyPair, cert *tls.Certificate) {
+	set.pairs = append(set.pairs, pair)
+	set.certs = append(set.certs, cert)
+
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if _, ok := set.byName[name]; !ok {
+			set.byName[name] = cert
+		}
+	}
+}
+
+/*
+get returns the certificate for serverName: one issued for exactly that name,
+else one for the wildcard "*.<parent domain>", else the default.
+*/
+func (set *certSet) get(serverName string) *tls.Certificate {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if cert, ok := set.byName[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := set.byName["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+	return set.certs[0]
+}
+
+func (cs *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.lock.RLock()
+	set := cs.set
+	cs.lock.RUnlock()
+
+	return set.get(hello.ServerName), nil
+}
+
+/*
+warnExpired logs a warning for every expired certificate srv serves.
+*/
+func (srv *endlessServer) warnExpired(set *certSet) {
+	for i, cert := range set.certs {
+		if expired(cert) {
+			srv.logEvent(slog.LevelWarn, "cert_expired", "Serving an expired certificate",
+				"cert", set.pairs[i].CertFile, "not_after", cert.Leaf.NotAfter)
+		}
+	}
+}
+
+/*
+certFiles returns the certificate files in use.
+*/
+func (cs *certStore) certFiles() (files []string) {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	for _, pair := range cs.set.pairs {
+		files = append(files, pair.CertFile)
+	}
+	return
+}
+
+/*
+reload reads the certificate files again. If any of them can't be loaded, or an
+expired certificate would replace one that is still valid, the old
+certificates stay in use.
+*/
+func (cs *certStore) reload() (set *certSet, err error) {
+	set, stamp, err := cs.load()
+	if err != nil {
+		return
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	for i, cert := range set.certs {
+		if !expired(cert) {
+			continue
+		}
+		for j, old := range cs.set.pairs {
+			if old.CertFile == set.pairs[i].CertFile && !expired(cs.set.certs[j]) {
+				return nil, fmt.Errorf("certificate %s expired at %s", old.CertFile, cert.Leaf.NotAfter)
+			}
+		}
+	}
+
+	cs.set = set
+	cs.loaded = stamp
+
+	return
+}
+
+/*
+certStamp identifies a version of the certificate files. Files replaced by
+renaming (or by swapping a symlink) get a new inode, files rewritten in place a
+new mtime.
+*/
+type certStamp string
+
+func stampPairs(pairs []CertKeyPair) (certStamp, error) {
+	var files []string
+	for _, pair := range pairs {
+		files = append(files, pair.CertFile, pair.KeyFile)
+	}
+	return stampFiles(files)
+}
+
+func stampFiles(files []string) (certStamp, error) {
+	var b strings.Builder
+	for _, path := range files {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		var ino uint64
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			ino = uint64(st.Ino)
+		}
+		fmt.Fprintf(&b, "%s %d %d %d\n", path, ino, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return certStamp(b.String()), nil
+}
+
+func (cs *certStore) stamp() (certStamp, error) {
+	pairs, err := cs.currentPairs()
+	if err != nil {
+		return "", err
+	}
+	return stampPairs(pairs)
+}
+
+/*
+watchCertificates polls the certificate files of srv every interval and
+reloads them when they changed. A change is only picked up once the files
+stayed the same for one interval, so that a certificate is not loaded with the
+key that belonged to the old one while they are being rewritten. Certificates
+that failed to load are not tried again until the files change.
+*/
+func (srv *endlessServer) watchCertificates(interval time.Duration) {
+	var pending, failed certStamp
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if st := srv.getState(); st == STATE_SHUTTING_DOWN || st == STATE_TERMINATE {
+			return
+		}
+
+		stamp, loaded, err := srv.certStamps()
+		if err != nil || stamp == loaded || stamp == failed {
+			// missing files are being replaced
+			pending = ""
+			continue
+		}
+		if stamp != pending {
+			// wait until they stop changing
+			pending = stamp
+			continue
+		}
+
+		srv.logEvent(slog.LevelInfo, "cert_change", "Certificate files changed")
+		if srv.reloadCertificates() != nil {
+			failed = stamp
+		}
+	}
+}
+
+/*
+certStamps returns the stamp of the certificate files of srv (its own and the
+client CAs) as they are now, and as they were when loaded.
+*/
+func (srv *endlessServer) certStamps() (stamp, loaded certStamp, err error) {
+	if srv.certs != nil {
+		stamp, err = srv.certs.stamp()
+		if err != nil {
+			return
+		}
+		srv.certs.lock.RLock()
+		loaded = srv.certs.loaded
+		srv.certs.lock.RUnlock()
+	}
+	if srv.clientCAs != nil {
+		var s certStamp
+		s, err = srv.clientCAs.stamp()
+		if err != nil {
+			return
+		}
+		srv.clientCAs.lock.RLock()
+		stamp += s
+		loaded += srv.clientCAs.loaded
+		srv.clientCAs.lock.RUnlock()
+	}
+	return
+}
+
+/*
+reloadCertificates reloads the certificates of srv if it serves TLS from
+certificate files, and the CAs client certificates are verified against.
+*/
+func (srv *endlessServer) reloadCertificates() error {
+	var errs []error
+
+	if srv.certs != nil {
+		set, err := srv.certs.reload()
+		if err != nil {
+			srv.logEvent(slog.LevelError, "cert_reload_error", "Failed to reload certificates, keeping the old ones",
+				"error", err)
+			errs = append(errs, err)
+		} else {
+			for i, cert := range set.certs {
+				srv.logEvent(slog.LevelInfo, "cert_reload", "Reloaded certificate",
+					"cert", set.pairs[i].CertFile, "not_after", cert.Leaf.NotAfter)
+			}
+			srv.warnExpired(set)
+		}
+	}
+
+	if srv.clientCAs != nil {
+		files, count, err := srv.clientCAs.reload()
+		if err != nil {
+			srv.logEvent(slog.LevelError, "client_ca_reload_error", "Failed to reload client CAs, keeping the old ones",
+				"error", err)
+			errs = append(errs, err)
+		} else {
+			srv.logEvent(slog.LevelInfo, "client_ca_reload", "Reloaded client CAs", "files", files, "count", count)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+/*
+reloadAllCertificates reloads the certificates of all servers.
+*/
+func reloadAllCertificates() error {
+	runningServerReg.RLock()
+	servers := make([]*endlessServer, 0, len(runningServersOrder))
+	for _, name := range runningServersOrder {
+		servers = append(servers, runningServers[name])
+	}
+	runningServerReg.RUnlock()
+
+	var errs []error
+	for _, srvPtr := range servers {
+		err := srvPtr.reloadCertificates()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", srvPtr.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,50 @@
+package endless
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestCertSetGet(t *testing.T) {
+	newCert := func(cn string, names ...string) *tls.Certificate {
+		return &tls.Certificate{Leaf: &x509.Certificate{
+			Subject:  pkix.Name{CommonName: cn},
+			DNSNames: names,
+		}}
+	}
+	def := newCert("", "default.example.com")
+	exact := newCert("", "www.Example.org", "example.org")
+	wildcard := newCert("", "*.example.org")
+	cn := newCert("cn.example.net")
+	// www.example.org is taken by exact already
+	late := newCert("", "www.example.org", "late.example.org")
+
+	set := &certSet{byName: map[string]*tls.Certificate{}}
+	for _, cert := range []*tls.Certificate{def, exact, wildcard, cn, late} {
+		set.add(CertKeyPair{}, cert)
+	}
+
+	tests := []struct {
+		serverName string
+		want       *tls.Certificate
+	}{
+		{"default.example.com", def},
+		{"www.example.org", exact},
+		{"WWW.EXAMPLE.ORG", exact},
+		{"www.example.org.", exact},
+		{"example.org", exact},
+		{"mail.example.org", wildcard},
+		{"late.example.org", late},
+		{"a.b.example.org", def},
+		{"cn.example.net", cn},
+		{"unknown.example.com", def},
+		{"", def},
+	}
+	for _, tt := range tests {
+		if got := set.get(tt.serverName); got != tt.want {
+			t.Errorf("get(%q) = %v, want %v", tt.serverName, got.Leaf, tt.want.Leaf)
+		}
+	}
+}
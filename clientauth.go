@@ -0,0 +1,227 @@
+package endless
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+/*
+clientCAStore holds the CA certificates client certificates are verified
+against. They are handed to each handshake through GetConfigForClient, so that
+reloaded CAs are used for new connections right away.
+*/
+type clientCAStore struct {
+	// a PEM bundle, or a directory of them
+	path string
+
+	lock  sync.RWMutex
+	pool  *x509.CertPool
+	files []string
+	// the files the CAs were loaded from
+	loaded certStamp
+}
+
+func newClientCAStore(path string) (cas *clientCAStore, err error) {
+	cas = &clientCAStore{
+		path: path,
+	}
+	_, _, err = cas.reload()
+	return
+}
+
+/*
+currentFiles returns the files to load the CAs from: path itself, or if it is
+a directory the *.crt and *.pem files in it, sorted by name.
+*/
+func (cas *clientCAStore) currentFiles() ([]string, error) {
+	fi, err := os.Stat(cas.path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{cas.path}, nil
+	}
+
+	entries, err := os.ReadDir(cas.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".crt" && ext != ".pem") {
+			continue
+		}
+		files = append(files, filepath.Join(cas.path, e.Name()))
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no CA certificates in %s", cas.path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+/*
+reload reads the CA files again. If any of them can't be loaded the old CAs
+stay in use. It returns the files and the number of certificates loaded.
+*/
+func (cas *clientCAStore) reload() (files []string, count int, err error) {
+	files, err = cas.currentFiles()
+	if err != nil {
+		return
+	}
+	stamp, _ := stampFiles(files)
+
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		certs, err := loadCACertificates(file)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+		count += len(certs)
+	}
+
+	cas.lock.Lock()
+	cas.pool = pool
+	cas.files = files
+	cas.loaded = stamp
+	cas.lock.Unlock()
+
+	return
+}
+
+/*
+loadCACertificates reads the PEM encoded certificates in file.
+*/
+func loadCACertificates(file string) (certs []*x509.Certificate, err error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no CA certificates in %s", file)
+	}
+	return
+}
+
+func (cas *clientCAStore) certPool() *x509.CertPool {
+	cas.lock.RLock()
+	defer cas.lock.RUnlock()
+
+	return cas.pool
+}
+
+/*
+caFiles returns the CA files in use.
+*/
+func (cas *clientCAStore) caFiles() []string {
+	cas.lock.RLock()
+	defer cas.lock.RUnlock()
+
+	return cas.files
+}
+
+func (cas *clientCAStore) stamp() (certStamp, error) {
+	files, err := cas.currentFiles()
+	if err != nil {
+		return "", err
+	}
+	return stampFiles(files)
+}
+
+/*
+setupClientAuth applies the client certificate settings of srv to config. The
+mode defaults to the ClientAuth of config, or to RequireAndVerifyClientCert if
+ClientCAPath is set. The CAs from ClientCAPath are served through
+GetConfigForClient, wrapping the one of config if there is one.
+*/
+func (srv *endlessServer) setupClientAuth(config *tls.Config) (err error) {
+	if srv.ClientAuth == tls.NoClientCert {
+		srv.ClientAuth = config.ClientAuth
+	}
+	if srv.ClientCAPath == "" {
+		config.ClientAuth = srv.ClientAuth
+		return
+	}
+	if srv.ClientAuth == tls.NoClientCert {
+		srv.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	srv.clientCAs, err = newClientCAStore(srv.ClientCAPath)
+	if err != nil {
+		return fmt.Errorf("client CAs: %v", err)
+	}
+
+	config.ClientAuth = srv.ClientAuth
+	config.ClientCAs = nil
+	getConfigForClient := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config
+		if getConfigForClient != nil {
+			cc, err := getConfigForClient(hello)
+			if err != nil {
+				return nil, err
+			}
+			if cc != nil {
+				c = cc
+			}
+		}
+		// Clone takes the current session ticket keys along
+		c = c.Clone()
+		c.GetConfigForClient = nil
+		c.ClientAuth = srv.ClientAuth
+		c.ClientCAs = srv.clientCAs.certPool()
+		return c, nil
+	}
+	return
+}
+
+/*
+clientAuthName returns the name of t for the handoff manifest, empty for
+NoClientCert.
+*/
+func clientAuthName(t tls.ClientAuthType) string {
+	if t == tls.NoClientCert {
+		return ""
+	}
+	return t.String()
+}
+
+/*
+PeerCertificate returns the verified certificate the client of r authenticated
+with, or nil if the client sent none or it was not verified (as with
+RequestClientCert or RequireAnyClientCert). The identity of the client is
+usually in its Subject.CommonName, DNSNames or URIs.
+*/
+func PeerCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
@@ -0,0 +1,224 @@
+/*
+endlessctl restarts, stops or hammers a running endless process and waits until
+that actually happened.
+
+	endlessctl [-control path | -pidfile path] [-timeout 60s] restart|stop|hammer|status
+
+The process is found by its control socket (see endless.ListenControl) or by
+its pid file (see endless.PidFile). With a control socket restart reports
+whether the child got ready, with a pid file it waits until the child replaced
+the pid in the file. stop waits until the process exited, hammer does the same
+but closes the connections still open instead of letting them finish.
+
+endlessctl exits with 1 if the command failed and 2 on usage errors.
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/bsc-s2/endless"
+)
+
+var (
+	controlPath string
+	pidFile     string
+	timeout     time.Duration
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: endlessctl [-control path | -pidfile path] [-timeout 60s] restart|stop|hammer|status\n\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("endlessctl: ")
+
+	flag.StringVar(&controlPath, "control", "", "control socket of the process")
+	flag.StringVar(&pidFile, "pidfile", "", "pid file of the process")
+	flag.DurationVar(&timeout, "timeout", 60*time.Second, "how long to wait for the restart or exit")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 1 || (controlPath == "") == (pidFile == "") {
+		usage()
+	}
+
+	var err error
+	switch cmd := flag.Arg(0); cmd {
+	case "restart", "stop", "hammer", "status":
+		if controlPath != "" {
+			err = viaControl(cmd)
+		} else {
+			err = viaPidFile(cmd)
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+/*
+viaControl runs cmd through the control socket.
+*/
+func viaControl(cmd string) error {
+	switch cmd {
+	case "restart":
+		reply, err := control("restart")
+		if err != nil {
+			return err
+		}
+		if !reply.ChildReady {
+			return fmt.Errorf("restart of pid %d failed: child %d did not take over: %s", reply.Pid, reply.Child, reply.Error)
+		}
+		fmt.Printf("restarted: pid %d -> %d (generation %d)\n", reply.Pid, reply.Child, reply.Generation+1)
+
+	case "stop", "hammer":
+		reply, err := control("shutdown")
+		if err != nil {
+			return err
+		}
+		err = waitExit(reply.Pid, cmd == "hammer")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("stopped: pid %d\n", reply.Pid)
+
+	case "status":
+		reply, err := control("status")
+		if err != nil {
+			return err
+		}
+		b, _ := json.MarshalIndent(reply, "", "  ")
+		fmt.Println(string(b))
+	}
+
+	return nil
+}
+
+/*
+control sends command to the control socket and returns the reply. A reply that
+is not OK is returned as an error.
+*/
+func control(command string) (*endless.ControlReply, error) {
+	c, err := net.DialTimeout("unix", controlPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+
+	req := endless.ControlRequest{Command: command}
+	err = json.NewEncoder(c).Encode(req)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &endless.ControlReply{}
+	err = json.NewDecoder(bufio.NewReader(c)).Decode(reply)
+	if err != nil {
+		return nil, fmt.Errorf("reading reply to %s: %v", command, err)
+	}
+	if !reply.OK {
+		return reply, fmt.Errorf("%s failed: %s", command, reply.Error)
+	}
+	return reply, nil
+}
+
+/*
+viaPidFile runs cmd by signalling the process named in the pid file.
+*/
+func viaPidFile(cmd string) error {
+	pid, err := endless.ReadPidFile(pidFile)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "restart":
+		err = syscall.Kill(pid, syscall.SIGHUP)
+		if err != nil {
+			return fmt.Errorf("signalling pid %d: %v", pid, err)
+		}
+		child, err := waitPidFileChange(pid)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restarted: pid %d -> %d\n", pid, child)
+
+	case "stop", "hammer":
+		err = syscall.Kill(pid, syscall.SIGTERM)
+		if err != nil {
+			return fmt.Errorf("signalling pid %d: %v", pid, err)
+		}
+		err = waitExit(pid, cmd == "hammer")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("stopped: pid %d\n", pid)
+
+	case "status":
+		if !alive(pid) {
+			return fmt.Errorf("pid %d from %s is not running", pid, pidFile)
+		}
+		fmt.Printf("running: pid %d\n", pid)
+	}
+
+	return nil
+}
+
+/*
+waitPidFileChange waits until a child replaced pid in the pid file, which it
+does once it got ready.
+*/
+func waitPidFileChange(pid int) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+
+		newPid, err := endless.ReadPidFile(pidFile)
+		if err == nil && newPid != pid {
+			return newPid, nil
+		}
+		if !alive(pid) {
+			return 0, fmt.Errorf("pid %d exited without a child taking over", pid)
+		}
+	}
+	return 0, fmt.Errorf("no child of pid %d got ready within %v", pid, timeout)
+}
+
+/*
+waitExit waits until pid exited. With hammer set the process gets SIGUSR2 for
+as long as it is shutting down, which closes the connections still open.
+*/
+func waitExit(pid int, hammer bool) error {
+	deadline := time.Now().Add(timeout)
+	for alive(pid) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pid %d did not exit within %v", pid, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if hammer {
+			syscall.Kill(pid, syscall.SIGUSR2)
+		}
+	}
+	return nil
+}
+
+func alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,268 @@
+package endless
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// restart replies not sent yet. Serve waits for them before returning, as the
+// child getting ready makes this process shut down.
+var pendingReplies sync.WaitGroup
+
+/*
+ControlRequest is a command sent to the control socket. Commands are sent one
+per line, either as JSON or as plain text ("wait-ready 10s").
+*/
+type ControlRequest struct {
+	// restart, shutdown, hammer, reload-certs, status or wait-ready
+	Command string `json:"command"`
+	// how long wait-ready waits, eg. "10s". empty waits forever
+	Timeout string `json:"timeout,omitempty"`
+}
+
+/*
+ControlReply is the answer to a ControlRequest, one line of JSON.
+*/
+type ControlReply struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	Pid        int  `json:"pid"`
+	Generation int  `json:"generation"`
+	Ready      bool `json:"ready"`
+
+	// restart: the forked child and whether it took over (got ready and
+	// lived through DefaultTakeoverGraceTime)
+	Child      int  `json:"child,omitempty"`
+	ChildReady bool `json:"child_ready,omitempty"`
+
+	// status
+	Ppid    int            `json:"ppid,omitempty"`
+	Forked  bool           `json:"forked,omitempty"`
+	Servers []ServerStatus `json:"servers,omitempty"`
+}
+
+/*
+ServerStatus describes one server in the status reply.
+*/
+type ServerStatus struct {
+	Name        string `json:"name"`
+	Addr        string `json:"addr"`
+	Network     string `json:"network"`
+	State       string `json:"state"`
+	ActiveConns int    `json:"active_conns"`
+}
+
+/*
+ListenControl starts serving the control socket at path in the background. The
+socket is created with permissions 0600. Like the sockets of the servers it is
+handed over to the child on restarts, so the child has to call ListenControl as
+well.
+
+Commands:
+
+	restart       fork a child and wait until it took over (or failed)
+	shutdown      shut down all servers
+	hammer        hammer servers that are shutting down
+	reload-certs  reload the TLS certificates from their files
+	status        pid, generation and the state of all servers
+	wait-ready    wait until all servers are listening
+*/
+func ListenControl(path string) error {
+	srv := newServer("unix", "", path, nil)
+	srv.SocketMode = 0600
+
+	el, err := srv.listen()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			c, err := el.Accept()
+			if err != nil {
+				return
+			}
+			go handleControlConn(srv, c)
+		}
+	}()
+
+	return nil
+}
+
+func handleControlConn(srv *endlessServer, c net.Conn) {
+	defer c.Close()
+
+	enc := json.NewEncoder(c)
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var req ControlRequest
+		if strings.HasPrefix(line, "{") {
+			err := json.Unmarshal([]byte(line), &req)
+			if err != nil {
+				enc.Encode(controlError(fmt.Errorf("invalid request: %v", err)))
+				continue
+			}
+		} else {
+			fields := strings.Fields(line)
+			req.Command = fields[0]
+			if len(fields) > 1 {
+				req.Timeout = fields[1]
+			}
+		}
+
+		srv.logEvent(slog.LevelInfo, "control", "Received control command", "command", req.Command)
+
+		var reply *ControlReply
+		var after func()
+		switch req.Command {
+		case "restart":
+			pendingReplies.Add(1)
+			reply = controlRestart(srv)
+			after = pendingReplies.Done
+		case "shutdown":
+			reply = newControlReply()
+			after = shutdownServers
+		case "hammer":
+			reply, after = controlHammer()
+		case "reload-certs":
+			reply = newControlReply()
+			if err := reloadAllCertificates(); err != nil {
+				reply = controlError(err)
+			}
+		case "status":
+			reply = controlStatus()
+		case "wait-ready":
+			reply = controlWaitReady(req.Timeout)
+		default:
+			reply = controlError(fmt.Errorf("unknown command %q", req.Command))
+		}
+
+		enc.Encode(reply)
+		if after != nil {
+			// reply first, the process may exit right after
+			after()
+		}
+	}
+}
+
+func newControlReply() *ControlReply {
+	reply := &ControlReply{
+		OK:         true,
+		Pid:        syscall.Getpid(),
+		Generation: generation,
+	}
+	select {
+	case <-processReady:
+		reply.Ready = true
+	default:
+	}
+
+	return reply
+}
+
+func controlError(err error) *ControlReply {
+	reply := newControlReply()
+	reply.OK = false
+	reply.Error = err.Error()
+	return reply
+}
+
+func controlRestart(srv *endlessServer) *ControlReply {
+	child, err := srv.restart()
+	if err != nil {
+		return controlError(err)
+	}
+
+	<-child.done
+
+	reply := newControlReply()
+	reply.Child = child.pid
+	if child.err != nil {
+		reply.OK = false
+		reply.Error = child.err.Error()
+	} else {
+		reply.ChildReady = true
+	}
+
+	return reply
+}
+
+func controlHammer() (reply *ControlReply, after func()) {
+	var hammer []*endlessServer
+	runningServerReg.RLock()
+	for _, srvPtr := range runningServers {
+		if srvPtr.getState() == STATE_SHUTTING_DOWN {
+			hammer = append(hammer, srvPtr)
+		}
+	}
+	runningServerReg.RUnlock()
+
+	if len(hammer) == 0 {
+		return controlError(errors.New("no server is shutting down")), nil
+	}
+
+	return newControlReply(), func() {
+		for _, srvPtr := range hammer {
+			srvPtr.hammerTime(0)
+		}
+	}
+}
+
+func controlStatus() *ControlReply {
+	reply := newControlReply()
+	reply.Ppid = syscall.Getppid()
+
+	runningServerReg.RLock()
+	defer runningServerReg.RUnlock()
+
+	reply.Forked = runningServersForked
+	for _, name := range runningServersOrder {
+		srvPtr, ok := runningServers[name]
+		if !ok {
+			continue
+		}
+		reply.Servers = append(reply.Servers, ServerStatus{
+			Name:        srvPtr.name,
+			Addr:        srvPtr.Addr,
+			Network:     srvPtr.network,
+			State:       stateName(srvPtr.getState()),
+			ActiveConns: srvPtr.activeConns(),
+		})
+	}
+
+	return reply
+}
+
+func controlWaitReady(timeout string) *ControlReply {
+	var expired <-chan time.Time
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return controlError(fmt.Errorf("invalid timeout: %v", err))
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-processReady:
+		return newControlReply()
+	case <-expired:
+		return controlError(fmt.Errorf("not ready after %s", timeout))
+	}
+}
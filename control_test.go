@@ -0,0 +1,61 @@
+package endless
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestHandleControlConn(t *testing.T) {
+	resetProcess(t)
+	srv := NewNamedServer("control-test", "localhost:0", nil)
+
+	tests := []struct {
+		line      string
+		wantOK    bool
+		wantError string
+	}{
+		{"status", true, ""},
+		{"  status  ", true, ""},
+		{`{"command":"status"}`, true, ""},
+		{"bogus", false, `unknown command "bogus"`},
+		{`{"command":"bogus"}`, false, `unknown command "bogus"`},
+		{`{"command":`, false, "invalid request: "},
+		{"wait-ready 1ms", false, "not ready after 1ms"},
+		{`{"command":"wait-ready","timeout":"1ms"}`, false, "not ready after 1ms"},
+		{"wait-ready soon", false, "invalid timeout: "},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleControlConn(srv, server)
+
+	// empty lines get no reply
+	fmt.Fprint(client, "\n  \n")
+
+	replies := bufio.NewScanner(client)
+	for _, tt := range tests {
+		fmt.Fprintf(client, "%s\n", tt.line)
+		if !replies.Scan() {
+			t.Fatalf("%q: no reply: %v", tt.line, replies.Err())
+		}
+
+		var reply ControlReply
+		err := json.Unmarshal(replies.Bytes(), &reply)
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if reply.OK != tt.wantOK || !strings.HasPrefix(reply.Error, tt.wantError) ||
+			(tt.wantError == "" && reply.Error != "") {
+			t.Errorf("%q: ok %v, error %q, want ok %v, error %q", tt.line, reply.OK, reply.Error, tt.wantOK, tt.wantError)
+		}
+		if reply.Pid != syscall.Getpid() {
+			t.Errorf("%q: pid %d, want %d", tt.line, reply.Pid, syscall.Getpid())
+		}
+	}
+}
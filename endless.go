@@ -1,16 +1,21 @@
 package endless
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
-	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -26,6 +31,7 @@ const (
 	STATE_RUNNING
 	STATE_SHUTTING_DOWN
 	STATE_TERMINATE
+	STATE_SUSPENDED
 )
 
 type LogPrintf func(format string, v ...interface{})
@@ -36,28 +42,57 @@ var (
 	runningServerReg     sync.RWMutex
 	runningServers       map[string]*endlessServer
 	runningServersOrder  []string
-	socketPtrOffsetMap   map[string]uint
 	runningServersForked bool
 
 	DefaultReadTimeOut    time.Duration
 	DefaultWriteTimeOut   time.Duration
 	DefaultMaxHeaderBytes int
 	DefaultHammerTime     time.Duration
+	DefaultReadyTimeout   time.Duration
+
+	DefaultTakeoverGraceTime time.Duration
+	DefaultUnclaimedTimeout  time.Duration
+	DefaultCertWatchInterval time.Duration
+	DefaultTicketKeyRotation time.Duration
 
 	isChild     bool
 	socketOrder string
+	// how many restarts it took to get to this process
+	generation int
+
+	// sockets passed by the parent that no server took over yet, by name
+	inheritedSockets map[string]*inheritedSocket
+	inheritedLoaded  bool
+	// the countdown to closeUnclaimedSockets is running
+	unclaimedTimerStarted bool
+
+	// readiness handshake between a forked child and its parent
+	readyPipe        *os.File
+	parentNotified   bool
+	listeningSockets int
+
+	// closed once all servers are listening (and a child told its parent)
+	processReady     = make(chan struct{})
+	processReadyOnce sync.Once
 
 	hookableSignals []os.Signal
 	logPrintf       LogPrintf
-	logFatalf       LogFatalf
-	logPrintln      LogPrintln
 )
 
 func init() {
 	runningServerReg = sync.RWMutex{}
 	runningServers = make(map[string]*endlessServer)
 	runningServersOrder = []string{}
-	socketPtrOffsetMap = make(map[string]uint)
+	inheritedSockets = make(map[string]*inheritedSocket)
+
+	// set once, they are read without holding runningServerReg
+	socketOrder = os.Getenv("ENDLESS_SOCKET_ORDER")
+	isChild = os.Getenv("ENDLESS_CONTINUE") != ""
+	generation, _ = strconv.Atoi(os.Getenv("ENDLESS_GENERATION"))
+	if isChild && generation == 0 {
+		// forked by an older version of endless
+		generation = 1
+	}
 
 	DefaultMaxHeaderBytes = 0 // use http.DefaultMaxHeaderBytes - which currently is 1 << 20 (1MB)
 
@@ -65,6 +100,31 @@ func init() {
 	// shutting down. set to a negative value to disable
 	DefaultHammerTime = 60 * time.Second
 
+	// a forked child that did not report ready within this time is killed
+	// and the parent keeps on serving. set to a negative value to wait
+	// forever
+	DefaultReadyTimeout = 60 * time.Second
+
+	// after the child got ready the parent can stop accepting but keep its
+	// sockets open for this long. if the child dies in the meantime the
+	// parent resumes serving. 0 shuts down right away
+	DefaultTakeoverGraceTime = 0
+
+	// a child closes the sockets it inherited but did not take over (the
+	// server moved to another address or is gone) this long after all of
+	// its servers are listening. it only reports ready after that. set to a
+	// negative value to keep them open
+	DefaultUnclaimedTimeout = 5 * time.Second
+
+	// how often ListenAndServeTLS checks its certificate files for changes.
+	// 0 does not watch them, they are only reloaded on SIGUSR1
+	DefaultCertWatchInterval = 0
+
+	// TLS servers share session ticket keys that are handed over to the
+	// child, a new one is added this often. 0 does not rotate them, a
+	// negative value leaves ticket keys to crypto/tls
+	DefaultTicketKeyRotation = 12 * time.Hour
+
 	hookableSignals = []os.Signal{
 		syscall.SIGHUP,
 		syscall.SIGUSR1,
@@ -75,21 +135,22 @@ func init() {
 	}
 
 	logPrintf = log.Printf
-	logFatalf = log.Fatalf
-	logPrintln = log.Println
 }
 
+/*
+SetLoggers sets the function endless prints its log lines with, unless a
+slog.Logger is set with SetLogger. The lines are printed with pf, or with pl if
+pf is nil. ff is ignored: nothing is fatal anymore, a child that fails to start
+is rolled back instead.
+*/
 func SetLoggers(pf LogPrintf, ff LogFatalf, pl LogPrintln) {
-	if pf != nil {
+	switch {
+	case pf != nil:
 		logPrintf = pf
-	}
-
-	if ff != nil {
-		logFatalf = ff
-	}
-
-	if pl != nil {
-		logPrintln = pl
+	case pl != nil:
+		logPrintf = func(format string, v ...interface{}) {
+			pl(fmt.Sprintf(format, v...))
+		}
 	}
 }
 
@@ -98,12 +159,44 @@ type endlessServer struct {
 	EndlessListener  net.Listener
 	SignalHooks      map[int]map[os.Signal][]func()
 	tlsInnerListener *endlessListener
+	certs            *certStore
+	clientCAs        *clientCAStore
+	packetConn       *endlessPacketConn
+	conns            map[*endlessConn]http.ConnState
+	connsLock        sync.Mutex
+	metrics          serverMetrics
 	wg               sync.WaitGroup
 	sigChan          chan os.Signal
 	isChild          bool
 	state            uint8
 	lock             *sync.RWMutex
 	BeforeBegin      func(add string)
+
+	// identifies the server across restarts, see NewNamedServer
+	name string
+	// network is "tcp" or "unix"
+	network string
+	// the socket came from systemd socket activation
+	socketActivated bool
+
+	// serving connections upgraded to h2c, see serveH2C. guarded by connsLock
+	h2cServers map[*http.Server]struct{}
+	// called once Serve set the state to STATE_RUNNING
+	onServe func()
+
+	// permissions and owner of unix sockets. -1 leaves the owner as is.
+	SocketMode os.FileMode
+	SocketUid  int
+	SocketGid  int
+
+	// serve cleartext HTTP/2 (h2c) next to HTTP/1.1 on servers without TLS
+	H2C bool
+
+	// client certificate authentication on TLS servers. ClientCAPath is a PEM
+	// file or a directory of them with the CAs to verify client certificates
+	// against, reloaded like the certificates of the server.
+	ClientAuth   tls.ClientAuthType
+	ClientCAPath string
 }
 
 /*
@@ -111,21 +204,44 @@ NewServer returns an intialized endlessServer Object. Calling Serve on it will
 actually "start" the server.
 */
 func NewServer(addr string, handler http.Handler) (srv *endlessServer) {
+	return newServer("tcp", "", addr, handler)
+}
+
+/*
+NewNamedServer is like NewServer, but the server is known as name instead of by
+its address. On restarts the child takes over the socket of the parent's server
+with the same name, whatever address it was given. This keeps servers on ":0",
+on addresses that are resolved differently in the child, or with more than one
+server on the same address apart.
+*/
+func NewNamedServer(name, addr string, handler http.Handler) (srv *endlessServer) {
+	return newServer("tcp", name, addr, handler)
+}
+
+/*
+newServer registers a new server. An empty name defaults to addr, prefixed with
+the network if that is not "tcp".
+*/
+func newServer(network, name, addr string, handler http.Handler) (srv *endlessServer) {
 	runningServerReg.Lock()
 	defer runningServerReg.Unlock()
 
-	socketOrder = os.Getenv("ENDLESS_SOCKET_ORDER")
-	isChild = os.Getenv("ENDLESS_CONTINUE") != ""
+	if name == "" {
+		name = addr
+		if network != "tcp" {
+			name = network + ":" + addr
+		}
+	} else if _, ok := runningServers[name]; ok {
+		logEvent(slog.LevelError, "start", "Server name is already in use", "name", name)
+	}
+	name = uniqueServerName(name)
 
-	logPrintf("is child? %v, pid: %v, ppid: %v\n",
-		isChild, syscall.Getpid(), syscall.Getppid())
+	logEvent(slog.LevelInfo, "start", fmt.Sprintf("is child? %v", isChild), "addr", addr)
 
-	if len(socketOrder) > 0 {
-		for i, addr := range strings.Split(socketOrder, ",") {
-			socketPtrOffsetMap[addr] = uint(i)
-		}
-	} else {
-		socketPtrOffsetMap[addr] = uint(len(runningServersOrder))
+	if isChild && !inheritedLoaded {
+		inheritedLoaded = true
+		loadInheritedSockets(name)
+		readyPipe = inheritedReadyPipe()
 	}
 
 	srv = &endlessServer{
@@ -151,8 +267,13 @@ func NewServer(addr string, handler http.Handler) (srv *endlessServer) {
 				syscall.SIGTSTP: []func(){},
 			},
 		},
-		state: STATE_INIT,
-		lock:  &sync.RWMutex{},
+		conns:     map[*endlessConn]http.ConnState{},
+		state:     STATE_INIT,
+		lock:      &sync.RWMutex{},
+		name:      name,
+		network:   network,
+		SocketUid: -1,
+		SocketGid: -1,
 	}
 
 	srv.Server.Addr = addr
@@ -162,15 +283,31 @@ func NewServer(addr string, handler http.Handler) (srv *endlessServer) {
 	srv.Server.Handler = handler
 
 	srv.BeforeBegin = func(addr string) {
-		logPrintln(syscall.Getpid(), addr)
+		srv.logEvent(slog.LevelInfo, "serve", "Serving")
 	}
 
-	runningServersOrder = append(runningServersOrder, addr)
-	runningServers[addr] = srv
+	runningServersOrder = append(runningServersOrder, name)
+	runningServers[name] = srv
 
 	return
 }
 
+/*
+uniqueServerName returns name, or if that is taken already name with "#2",
+"#3"... appended. runningServerReg must be held.
+*/
+func uniqueServerName(name string) string {
+	if _, ok := runningServers[name]; !ok {
+		return name
+	}
+	for i := 2; ; i++ {
+		n := fmt.Sprintf("%s#%d", name, i)
+		if _, ok := runningServers[n]; !ok {
+			return n
+		}
+	}
+}
+
 /*
 ListenAndServe listens on the TCP network address addr and then calls Serve
 with handler to handle requests on incoming connections. Handler is typically
@@ -193,6 +330,45 @@ func ListenAndServeTLS(addr string, certFile string, keyFile string, handler htt
 	return server.ListenAndServeTLS(certFile, keyFile)
 }
 
+/*
+ListenAndServeTLSCerts is like ListenAndServeTLS but serves several
+certificates, chosen by the server name the client asks for (SNI).
+*/
+func ListenAndServeTLSCerts(addr string, certs []CertKeyPair, handler http.Handler) error {
+	server := NewServer(addr, handler)
+	return server.ListenAndServeTLSCerts(certs)
+}
+
+/*
+ListenAndServeTLSConfig is like ListenAndServeTLS with the certificates of
+config instead of certificate files.
+*/
+func ListenAndServeTLSConfig(addr string, config *tls.Config, handler http.Handler) error {
+	server := NewServer(addr, handler)
+	return server.ListenAndServeTLSConfig(config)
+}
+
+/*
+ListenAndServeTLSDir is like ListenAndServeTLSCerts with the certificates found
+in dir.
+*/
+func ListenAndServeTLSDir(addr string, dir string, handler http.Handler) error {
+	server := NewServer(addr, handler)
+	return server.ListenAndServeTLSDir(dir)
+}
+
+/*
+ListenAndServeMutualTLS is like ListenAndServeTLS, but clients have to present a
+certificate issued by one of the CAs in clientCAs, a PEM file or a directory of
+them. Handlers get the client certificate from PeerCertificate.
+*/
+func ListenAndServeMutualTLS(addr, certFile, keyFile, clientCAs string, handler http.Handler) error {
+	server := NewServer(addr, handler)
+	server.ClientAuth = tls.RequireAndVerifyClientCert
+	server.ClientCAPath = clientCAs
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
 func (srv *endlessServer) getState() uint8 {
 	srv.lock.RLock()
 	defer srv.lock.RUnlock()
@@ -218,11 +394,32 @@ sync.Waitgroup so that all outstanding connections can be served before shutting
 down the server.
 */
 func (srv *endlessServer) Serve() (err error) {
-	defer logPrintln(syscall.Getpid(), "Serve() returning...")
+	defer srv.logEvent(slog.LevelInfo, "serve_return", "Serve() returning...")
 	srv.setState(STATE_RUNNING)
+	if srv.onServe != nil {
+		srv.onServe()
+	}
+
+	if srv.H2C && srv.tlsInnerListener == nil {
+		srv.enableH2C()
+	}
+
+	// learn which connections are idle
+	connState := srv.Server.ConnState
+	srv.Server.ConnState = func(c net.Conn, st http.ConnState) {
+		srv.trackConnState(c, st)
+		if connState != nil {
+			connState(c, st)
+		}
+	}
+
 	err = srv.Server.Serve(srv.EndlessListener)
-	logPrintln(syscall.Getpid(), "Waiting for connections to finish...")
+	srv.logEvent(slog.LevelInfo, "drain", "Waiting for connections to finish...",
+		"error", err)
 	srv.wg.Wait()
+	srv.metrics.drained()
+	// let the control socket tell about the restart that brought us here
+	pendingReplies.Wait()
 	srv.setState(STATE_TERMINATE)
 	return
 }
@@ -242,37 +439,13 @@ func (srv *endlessServer) ListenAndServe() (err error) {
 
 	l, err := srv.getListener(addr)
 	if err != nil {
-		logPrintln(err)
+		srv.logEvent(slog.LevelError, "listen_error", err.Error())
 		return
 	}
 
 	srv.EndlessListener = newEndlessListener(l, srv)
 
-	if srv.isChild {
-		ppid := syscall.Getppid()
-
-		event := fmt.Sprintf("send sigterm from %d to parent %d",
-			syscall.Getpid(), ppid)
-
-		for cnt := 0; cnt < 3; cnt++ {
-			// child sends SIGTERM to parent.
-			// if parent quits immediately, the new parent of child
-			// is process 1. But parent may be processing other requests,
-			// so here, the reasonable way is to send SIGTERM n times to
-			// parent and the longest time we wait is n*10ms.
-			// here we use 3 as n.
-			if ppid == 1 {
-				logPrintf("%s, ppid is 1", event)
-
-				break
-			}
-
-			kErr := syscall.Kill(ppid, syscall.SIGTERM)
-			logPrintf("%s, err: %v\n", event, kErr)
-
-			time.Sleep(10 * time.Millisecond)
-		}
-	}
+	srv.listening()
 
 	srv.BeforeBegin(srv.Addr)
 
@@ -288,24 +461,108 @@ be provided. If the certificate is signed by a certificate authority, the
 certFile should be the concatenation of the server's certificate followed by the
 CA's certificate.
 
+If certFile and keyFile are both empty the certificates configured in
+srv.TLSConfig are used, see ListenAndServeTLSConfig.
+
 If srv.Addr is blank, ":https" is used.
 */
 func (srv *endlessServer) ListenAndServeTLS(certFile, keyFile string) (err error) {
-	addr := srv.Addr
-	if addr == "" {
-		addr = ":https"
+	if certFile == "" && keyFile == "" {
+		return srv.ListenAndServeTLSConfig(nil)
 	}
+	return srv.listenAndServeTLS([]CertKeyPair{{certFile, keyFile}}, "")
+}
 
-	config := &tls.Config{}
-	if srv.TLSConfig != nil {
-		*config = *srv.TLSConfig
+/*
+ListenAndServeTLSCerts is like ListenAndServeTLS but serves several
+certificates. The one for a connection is picked by the server name the client
+asks for (SNI): a certificate issued for exactly that name, else one for a
+matching wildcard name ("*.example.com"), else the first one.
+*/
+func (srv *endlessServer) ListenAndServeTLSCerts(certs []CertKeyPair) (err error) {
+	if len(certs) == 0 {
+		return errors.New("no certificates given")
+	}
+	return srv.listenAndServeTLS(certs, "")
+}
+
+/*
+ListenAndServeTLSDir is like ListenAndServeTLSCerts with the certificates found
+in dir: each <name>.crt (or <name>.pem) with its key in <name>.key. default.crt
+is the one used if no other matches, else the first one by name. Certificates
+added to dir are picked up when they get reloaded.
+*/
+func (srv *endlessServer) ListenAndServeTLSDir(dir string) (err error) {
+	return srv.listenAndServeTLS(nil, dir)
+}
+
+func (srv *endlessServer) listenAndServeTLS(certs []CertKeyPair, dir string) (err error) {
+	config := srv.tlsConfig(srv.TLSConfig)
+
+	// served through GetCertificate, so that SIGUSR1 can swap them
+	srv.certs, err = newCertStore(certs, dir)
+	if err != nil {
+		return
+	}
+	// rather than not serving at all
+	srv.warnExpired(srv.certs.set)
+	config.Certificates = nil
+	config.GetCertificate = srv.certs.GetCertificate
+
+	return srv.serveTLS(config, true)
+}
+
+/*
+ListenAndServeTLSConfig is like ListenAndServeTLS, but the certificates come
+from config (Certificates, GetCertificate or GetConfigForClient) instead of
+files, eg. for keys that are never written to disk. A copy of config is used
+as it is, except that NextProtos is filled in if it is empty. This includes its
+session tickets: they are neither shared with the other servers nor handed over
+to the child (see DefaultTicketKeyRotation), keys set with SetSessionTicketKeys
+are kept. If config is nil srv.TLSConfig is used.
+*/
+func (srv *endlessServer) ListenAndServeTLSConfig(config *tls.Config) (err error) {
+	if config == nil {
+		config = srv.TLSConfig
+	}
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil) {
+		return errors.New("tls: neither Certificates, GetCertificate, nor GetConfigForClient set in Config")
+	}
+
+	return srv.serveTLS(srv.tlsConfig(config), false)
+}
+
+/*
+tlsConfig returns a copy of config (which may be nil) with the protocols to
+offer filled in.
+*/
+func (srv *endlessServer) tlsConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
 	}
 	if config.NextProtos == nil {
 		config.NextProtos = []string{"http/1.1"}
+		if srv.http2Enabled() {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
 	}
+	return config
+}
 
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+/*
+serveTLS listens on srv.Addr (or takes over the socket from the parent) and
+serves TLS with config. With shareTickets config gets the shared session ticket
+keys.
+*/
+func (srv *endlessServer) serveTLS(config *tls.Config, shareTickets bool) (err error) {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":https"
+	}
+
+	err = srv.setupClientAuth(config)
 	if err != nil {
 		return
 	}
@@ -314,21 +571,25 @@ func (srv *endlessServer) ListenAndServeTLS(certFile, keyFile string) (err error
 
 	l, err := srv.getListener(addr)
 	if err != nil {
-		logPrintln(err)
+		srv.logEvent(slog.LevelError, "listen_error", err.Error())
 		return
 	}
 
+	if shareTickets {
+		installTicketKeys(config)
+	}
 	srv.tlsInnerListener = newEndlessListener(l, srv)
 	srv.EndlessListener = tls.NewListener(srv.tlsInnerListener, config)
+	// net/http only sets up HTTP/2 if the TLSConfig of the server offers it
+	srv.TLSConfig = config
 
-	if srv.isChild {
-		kErr := syscall.Kill(syscall.Getppid(), syscall.SIGTERM)
-
-		logPrintf("error while sending sigterm from %v to parent %v, %v\n",
-			syscall.Getpid(), syscall.Getppid(), kErr)
+	if (srv.certs != nil || srv.clientCAs != nil) && DefaultCertWatchInterval > 0 {
+		go srv.watchCertificates(DefaultCertWatchInterval)
 	}
 
-	logPrintln(syscall.Getpid(), srv.Addr)
+	srv.listening()
+
+	srv.logEvent(slog.LevelInfo, "serve", "Serving TLS")
 	return srv.Serve()
 }
 
@@ -337,23 +598,31 @@ getListener either opens a new socket to listen on, or takes the acceptor socket
 it got passed when restarted.
 */
 func (srv *endlessServer) getListener(laddr string) (l net.Listener, err error) {
-	if srv.isChild {
-		var ptrOffset uint = 0
-		runningServerReg.RLock()
-		defer runningServerReg.RUnlock()
-		if len(socketPtrOffsetMap) > 0 {
-			ptrOffset = socketPtrOffsetMap[laddr]
-			// logPrintln("laddr", laddr, "ptr offset", socketPtrOffsetMap[laddr])
-		}
-
-		f := os.NewFile(uintptr(3+ptrOffset), "")
+	f, err := srv.claimInheritedSocket(laddr)
+	if err != nil {
+		return
+	}
+	if f != nil {
+		defer f.Close()
 		l, err = net.FileListener(f)
 		if err != nil {
 			err = fmt.Errorf("net.FileListener error: %v", err)
-			return
 		}
+		return
+	}
+
+	// systemd may have passed us a socket, children get the ones their
+	// parent did not use
+	l, err = activatedListener(srv.network, srv.name, laddr)
+	if l != nil || err != nil {
+		srv.socketActivated = true
+		return
+	}
+
+	if srv.network == "unix" {
+		l, err = srv.listenUnix(laddr)
 	} else {
-		l, err = net.Listen("tcp", laddr)
+		l, err = net.Listen(srv.network, laddr)
 		if err != nil {
 			err = fmt.Errorf("net.Listen error: %v", err)
 			return
@@ -362,6 +631,277 @@ func (srv *endlessServer) getListener(laddr string) (l net.Listener, err error)
 	return
 }
 
+/*
+loadInheritedSockets picks up the sockets the parent passed to us. They are
+described by the handoff manifest, each socket is checked against it. Older
+parents list them by server name in ENDLESS_SOCKET_ORDER, starting at fd 3, or
+pass a single socket which belongs to the first server, name. If the parent
+passed a manifest that can't be read the sockets are not used at all: the
+servers fail to start and the parent rolls back.
+
+Sockets no server claimed DefaultUnclaimedTimeout after all servers are
+listening are closed, see listening. runningServerReg must be held.
+*/
+func loadInheritedSockets(name string) {
+	manifest, manifestErr := readManifest()
+	if errors.Is(manifestErr, errManifestVersion) {
+		logEvent(slog.LevelWarn, "manifest_error",
+			"Unknown handoff manifest, using ENDLESS_SOCKET_ORDER", "error", manifestErr)
+		manifestErr = nil
+	} else if manifestErr != nil {
+		logEvent(slog.LevelError, "manifest_error",
+			"Failed to read handoff manifest, not using the inherited sockets", "error", manifestErr)
+		manifestErr = fmt.Errorf("handoff manifest: %v", manifestErr)
+	}
+
+	switch {
+	case manifest != nil:
+		takeOverTicketKeys(manifest)
+		for _, s := range manifest.Sockets {
+			err := s.check(manifest)
+			if err != nil {
+				logEvent(slog.LevelError, "inherit_error", "Inherited socket does not match the manifest",
+					"name", s.Name, "fd", s.Fd, "error", err)
+			} else {
+				logEvent(slog.LevelInfo, "inherit", "Inherited socket", "name", s.Name, "fd", s.Fd,
+					"network", s.Network, "address", s.Address, "tls", s.TLS)
+			}
+			inheritedSockets[s.Name] = &inheritedSocket{fd: s.Fd, network: s.Network, address: s.Address,
+				activated: s.Activated, tls: s.TLS, certs: s.Certs, clientAuth: s.ClientAuth, clientCAs: s.ClientCAs, err: err}
+		}
+	case socketOrder == "":
+		inheritedSockets[name] = &inheritedSocket{fd: 3, err: manifestErr}
+	default:
+		for i, name := range strings.Split(socketOrder, ",") {
+			inheritedSockets[name] = &inheritedSocket{fd: 3 + i, err: manifestErr}
+		}
+	}
+}
+
+/*
+claimInheritedSocket returns the socket the parent passed to us for srv, or nil
+if there is none. Sockets are matched by server name, else by the address they
+are bound to, so that a server whose address is written differently (":8080"
+and "0.0.0.0:8080") does not try to bind it again. A socket can only be claimed
+once. If the socket did not pass the checks, or belongs to another network, an
+error is returned instead of serving on the wrong socket.
+*/
+func (srv *endlessServer) claimInheritedSocket(laddr string) (*os.File, error) {
+	runningServerReg.Lock()
+	defer runningServerReg.Unlock()
+
+	name := srv.name
+	is, ok := inheritedSockets[name]
+	if !ok {
+		name, is = inheritedSocketBoundTo(srv.network, laddr)
+		if is == nil {
+			return nil, nil
+		}
+		srv.logEvent(slog.LevelInfo, "inherit", "Taking over inherited socket bound to the address",
+			"parent_name", name, "address", is.address)
+	}
+	delete(inheritedSockets, name)
+
+	if is.err == nil && is.network != "" && is.network != srv.network {
+		is.err = fmt.Errorf("it is a %s socket, not %s", is.network, srv.network)
+	}
+	if is.err != nil {
+		syscall.Close(is.fd)
+		return nil, fmt.Errorf("inherited socket %s: %v", srv.name, is.err)
+	}
+	// the parent got it from systemd, so its file is not ours to remove
+	srv.socketActivated = is.activated
+
+	if srv.certs != nil && is.certs != nil {
+		certs := srv.certs.certFiles()
+		if !slices.Equal(certs, is.certs) {
+			srv.logEvent(slog.LevelWarn, "cert_mismatch", "Serving other certificates than the parent",
+				"certs", certs, "parent_certs", is.certs)
+		}
+	}
+	if is.tls {
+		clientAuth := clientAuthName(srv.ClientAuth)
+		var clientCAs []string
+		if srv.clientCAs != nil {
+			clientCAs = srv.clientCAs.caFiles()
+		}
+		if clientAuth != is.clientAuth || !slices.Equal(clientCAs, is.clientCAs) {
+			srv.logEvent(slog.LevelWarn, "client_auth_mismatch", "Authenticating clients other than the parent",
+				"client_auth", clientAuth, "parent_client_auth", is.clientAuth,
+				"client_cas", clientCAs, "parent_client_cas", is.clientCAs)
+		}
+	}
+
+	return os.NewFile(uintptr(is.fd), srv.name), nil
+}
+
+/*
+inheritedSocketBoundTo returns an inherited socket of network bound to laddr
+(see addrMatches) and its name. Only sockets described by the manifest are
+considered, the others have no address. runningServerReg must be held.
+*/
+func inheritedSocketBoundTo(network, laddr string) (string, *inheritedSocket) {
+	for name, is := range inheritedSockets {
+		if is.err != nil || is.address == "" || is.network != network {
+			continue
+		}
+		addr := socketNetAddr(is.network, is.address)
+		if addr != nil && addrMatches(network, laddr, addr) {
+			return name, is
+		}
+	}
+	return "", nil
+}
+
+/*
+closeUnclaimedSockets closes the inherited sockets no server took over. The
+parent keeps serving on them until we are ready.
+*/
+func closeUnclaimedSockets() {
+	runningServerReg.Lock()
+	for name, is := range inheritedSockets {
+		logEvent(slog.LevelWarn, "unclaimed", "Closing inherited socket no server took over",
+			"name", name, "timeout", DefaultUnclaimedTimeout)
+		syscall.Close(is.fd)
+		delete(inheritedSockets, name)
+	}
+	runningServerReg.Unlock()
+
+	checkReady()
+}
+
+/*
+inheritedReadyPipe returns the write end of the readiness pipe the parent
+passed to us in ENDLESS_READY_FD, or nil if the parent did not pass one (eg. it
+runs an older version of endless).
+*/
+func inheritedReadyPipe() *os.File {
+	fd, err := strconv.Atoi(os.Getenv("ENDLESS_READY_FD"))
+	if err != nil || fd < 3 {
+		return nil
+	}
+	// don't leak the pipe into processes we exec ourselves, they would keep
+	// the parent from noticing that we died
+	syscall.CloseOnExec(fd)
+
+	return os.NewFile(uintptr(fd), "endless-ready")
+}
+
+/*
+listening is called once srv is listening. Once all servers are, the inherited
+sockets none of them took over get closed after DefaultUnclaimedTimeout.
+*/
+func (srv *endlessServer) listening() {
+	runningServerReg.Lock()
+	listeningSockets++
+	if listeningSockets >= len(runningServers) && len(inheritedSockets) > 0 &&
+		!unclaimedTimerStarted && DefaultUnclaimedTimeout >= 0 {
+		unclaimedTimerStarted = true
+		time.AfterFunc(DefaultUnclaimedTimeout, closeUnclaimedSockets)
+	}
+	legacy := srv.isChild && readyPipe == nil && !parentNotified
+	first := listeningSockets == 1
+	runningServerReg.Unlock()
+
+	if legacy {
+		// forked by an older version of endless, it waits for SIGTERM
+		signalParent()
+		if first {
+			becameReady(fmt.Sprintf("MAINPID=%d\nREADY=1", syscall.Getpid()))
+		}
+		return
+	}
+
+	checkReady()
+}
+
+/*
+checkReady finds out whether this process is ready: all servers are listening
+and every socket inherited from the parent was either taken over by a server or
+closed. A child then tells its parent, otherwise systemd gets told.
+*/
+func checkReady() {
+	runningServerReg.RLock()
+	ready := listeningSockets > 0 && listeningSockets >= len(runningServers) && len(inheritedSockets) == 0
+	runningServerReg.RUnlock()
+
+	if !ready {
+		return
+	}
+	if isChild {
+		notifyParent()
+	} else {
+		becameReady("READY=1")
+	}
+}
+
+/*
+handedOver tells whether a forked child is taking over (or took over) our
+sockets.
+*/
+func handedOver() bool {
+	runningServerReg.RLock()
+	defer runningServerReg.RUnlock()
+
+	return runningServersForked
+}
+
+/*
+notifyParent is called by a child once it is ready. It reports "ready" to the
+parent through the readiness pipe, the parent will only start shutting down
+after it got that message.
+*/
+func notifyParent() {
+	runningServerReg.Lock()
+	defer runningServerReg.Unlock()
+
+	if readyPipe == nil {
+		return
+	}
+
+	ppid := syscall.Getppid()
+	_, err := fmt.Fprintf(readyPipe, "ready %d\n", syscall.Getpid())
+	if err != nil {
+		logEvent(slog.LevelError, "ready_error", "Failed to notify parent", "error", err)
+	} else {
+		logEvent(slog.LevelInfo, "ready", "Notified parent that we are ready", "parent", ppid)
+	}
+	readyPipe.Close()
+	readyPipe = nil
+	parentNotified = true
+
+	// we are the main process now
+	becameReady(fmt.Sprintf("MAINPID=%d\nREADY=1", syscall.Getpid()))
+}
+
+/*
+signalParent sends SIGTERM to the parent. This is how a child told its parent
+to shut down before there was a readiness pipe.
+*/
+func signalParent() {
+	ppid := syscall.Getppid()
+
+	for cnt := 0; cnt < 3; cnt++ {
+		// child sends SIGTERM to parent.
+		// if parent quits immediately, the new parent of child
+		// is process 1. But parent may be processing other requests,
+		// so here, the reasonable way is to send SIGTERM n times to
+		// parent and the longest time we wait is n*10ms.
+		// here we use 3 as n.
+		if ppid == 1 {
+			logEvent(slog.LevelWarn, "signal_parent", "Parent already exited")
+
+			break
+		}
+
+		kErr := syscall.Kill(ppid, syscall.SIGTERM)
+		logEvent(slog.LevelInfo, "signal_parent", "Sent SIGTERM to parent",
+			"parent", ppid, "error", kErr)
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 /*
 handleSignals listens for os Signals and calls any hooked in function that the
 user had registered with the signal.
@@ -374,32 +914,29 @@ func (srv *endlessServer) handleSignals() {
 		hookableSignals...,
 	)
 
-	pid := syscall.Getpid()
 	for {
 		sig = <-srv.sigChan
 		srv.signalHooks(PRE_SIGNAL, sig)
 		switch sig {
 		case syscall.SIGHUP:
-			logPrintln(pid, "Received SIGHUP. forking.")
-			err := srv.fork()
-			if err != nil {
-				logPrintln("Fork err:", err)
-			}
+			srv.logEvent(slog.LevelInfo, "signal", "Received SIGHUP. forking.", "signal", sig.String())
+			srv.restart()
 		case syscall.SIGUSR1:
-			logPrintln(pid, "Received SIGUSR1.")
+			srv.logEvent(slog.LevelInfo, "signal", "Received SIGUSR1. reloading certificates.", "signal", sig.String())
+			srv.reloadCertificates()
 		case syscall.SIGUSR2:
-			logPrintln(pid, "Received SIGUSR2.")
+			srv.logEvent(slog.LevelInfo, "signal", "Received SIGUSR2.", "signal", sig.String())
 			srv.hammerTime(0 * time.Second)
 		case syscall.SIGINT:
-			logPrintln(pid, "Received SIGINT.")
+			srv.logEvent(slog.LevelInfo, "signal", "Received SIGINT.", "signal", sig.String())
 			srv.shutdown()
 		case syscall.SIGTERM:
-			logPrintln(pid, "Received SIGTERM.")
+			srv.logEvent(slog.LevelInfo, "signal", "Received SIGTERM.", "signal", sig.String())
 			srv.shutdown()
 		case syscall.SIGTSTP:
-			logPrintln(pid, "Received SIGTSTP.")
+			srv.logEvent(slog.LevelInfo, "signal", "Received SIGTSTP.", "signal", sig.String())
 		default:
-			logPrintf("Received %v: nothing i care about...\n", sig)
+			srv.logEvent(slog.LevelInfo, "signal", "Received signal: nothing i care about...", "signal", sig.String())
 		}
 		srv.signalHooks(POST_SIGNAL, sig)
 	}
@@ -421,22 +958,143 @@ starts a goroutine that will hammer (stop all running requests) the server
 after DefaultHammerTime.
 */
 func (srv *endlessServer) shutdown() {
-	if srv.getState() != STATE_RUNNING {
+	if st := srv.getState(); st != STATE_RUNNING && st != STATE_SUSPENDED {
 		return
 	}
 
 	srv.setState(STATE_SHUTTING_DOWN)
+	srv.metrics.startDrain()
 	if DefaultHammerTime >= 0 {
 		go srv.hammerTime(DefaultHammerTime)
 	}
+	if !handedOver() {
+		sdNotify("STOPPING=1")
+		removePidFile()
+	}
+	if srv.packetConn != nil {
+		srv.packetConn.stop()
+		srv.logEvent(slog.LevelInfo, "shutdown", "PacketConn stopped reading.")
+		return
+	}
+
 	// disable keep-alives on existing connections
 	srv.SetKeepAlivesEnabled(false)
+	if srv.network == "unix" {
+		// before closing, Serve() returns right after that
+		srv.unlinkUnixSocket()
+	}
 	err := srv.EndlessListener.Close()
 	if err != nil {
-		logPrintln(syscall.Getpid(), "Listener.Close() error:", err)
+		srv.logEvent(slog.LevelError, "shutdown", "Listener.Close() error", "error", err)
 	} else {
-		logPrintln(syscall.Getpid(), srv.EndlessListener.Addr(), "Listener closed.")
+		srv.logEvent(slog.LevelInfo, "shutdown", "Listener closed.")
 	}
+
+	// instead of disabled keep-alives HTTP/2 clients need a GOAWAY
+	srv.goAway()
+}
+
+/*
+suspend stops accepting new connections but keeps the listening socket open so
+that serving can be resumed. Outstanding requests are finished, keep-alives are
+disabled.
+*/
+func (srv *endlessServer) suspend() {
+	if srv.getState() != STATE_RUNNING {
+		return
+	}
+
+	srv.setState(STATE_SUSPENDED)
+	if srv.packetConn != nil {
+		srv.packetConn.pause()
+	} else {
+		srv.SetKeepAlivesEnabled(false)
+		srv.listener().pause()
+	}
+	srv.logEvent(slog.LevelInfo, "suspend", "Suspended.")
+}
+
+/*
+resume undoes suspend. It tells whether srv was suspended, it is not resumed if
+it got shut down in the meantime.
+*/
+func (srv *endlessServer) resume() bool {
+	if srv.getState() != STATE_SUSPENDED {
+		return false
+	}
+
+	srv.setState(STATE_RUNNING)
+	if srv.packetConn != nil {
+		srv.packetConn.resume()
+	} else {
+		srv.SetKeepAlivesEnabled(true)
+		srv.listener().resume()
+	}
+	srv.logEvent(slog.LevelInfo, "resume", "Resumed.")
+	return true
+}
+
+/*
+listener returns the endlessListener of srv. For TLS servers this is the
+listener wrapped by the tls.listener.
+*/
+func (srv *endlessServer) listener() *endlessListener {
+	if el, ok := srv.EndlessListener.(*endlessListener); ok {
+		return el
+	}
+
+	return srv.tlsInnerListener
+}
+
+/*
+file returns a dup of the socket of srv to be handed over to a child, or nil if
+srv has no socket yet.
+*/
+func (srv *endlessServer) file() *os.File {
+	if srv.packetConn != nil {
+		return srv.packetConn.File()
+	}
+
+	if el := srv.listener(); el != nil {
+		return el.File()
+	}
+
+	return nil
+}
+
+/*
+Shutdown gracefully shuts down the server: it stops accepting new connections,
+closes idle connections, and waits for the active ones to finish. If ctx is done
+before that the remaining connections are closed and ctx.Err() is returned.
+
+Serve returns once all connections are closed.
+*/
+func (srv *endlessServer) Shutdown(ctx context.Context) error {
+	srv.shutdown()
+	srv.closeIdleConns()
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		srv.closeConns()
+		return ctx.Err()
+	}
+}
+
+/*
+Close stops accepting new connections and closes all connections right away.
+*/
+func (srv *endlessServer) Close() error {
+	srv.shutdown()
+	srv.closeConns()
+	return nil
 }
 
 /*
@@ -444,67 +1102,155 @@ hammerTime forces the server to shutdown in a given timeout - whether it
 finished outstanding requests or not. if Read/WriteTimeout are not set or the
 max header size is very big a connection could hang...
 
-srv.Serve() will not return until all connections are served. this will
-unblock the srv.wg.Wait() in Serve() thus causing ListenAndServe(TLS) to
-return.
+srv.Serve() will not return until all connections are served. hammerTime closes
+the connections still open after d. this will unblock the srv.wg.Wait() in
+Serve() thus causing ListenAndServe(TLS) to return.
 */
 func (srv *endlessServer) hammerTime(d time.Duration) {
-	defer func() {
-		// we are calling srv.wg.Done() until it panics which means we called
-		// Done() when the counter was already at 0 and we're done.
-		// (and thus Serve() will return and the parent will exit)
-		if r := recover(); r != nil {
-			logPrintln("WaitGroup at 0", r)
-		}
-	}()
 	if srv.getState() != STATE_SHUTTING_DOWN {
 		return
 	}
 	time.Sleep(d)
-	logPrintln("[STOP - Hammer Time] Forcefully shutting down parent")
-	for {
-		if srv.getState() == STATE_TERMINATE {
-			break
-		}
-		srv.wg.Done()
-		runtime.Gosched()
+	if srv.activeConns() == 0 {
+		return
 	}
+	srv.logEvent(slog.LevelWarn, "hammer", "[STOP - Hammer Time] Forcefully shutting down parent",
+		"conns", srv.activeConns())
+	srv.closeConns()
 }
 
-func (srv *endlessServer) fork() (err error) {
+/*
+restart forks a child to take over. The returned forkedChild tells when the
+child got ready or failed.
+*/
+func (srv *endlessServer) restart() (child *forkedChild, err error) {
+	child, err = srv.fork()
+	if err == errAlreadyForked {
+		// every server gets the SIGHUP, the first one forks. a control
+		// socket restart gets the error in its reply
+		return
+	}
+	if err != nil {
+		srv.logEvent(slog.LevelError, "fork_error", "Fork err", "error", err)
+		sdNotify("READY=1")
+	}
+	return
+}
+
+var errAlreadyForked = errors.New("Another process already forked. Ignoring this one.")
+
+/*
+forkedChild is a child started by fork.
+*/
+type forkedChild struct {
+	pid int
+	// closed once the child took over, that is got ready and lived through
+	// DefaultTakeoverGraceTime, or failed to
+	done chan struct{}
+	// why the child did not take over
+	err error
+}
+
+func (srv *endlessServer) fork() (child *forkedChild, err error) {
 	runningServerReg.Lock()
 	defer runningServerReg.Unlock()
 
 	// only one server instance should fork!
 	if runningServersForked {
-		return errors.New("Another process already forked. Ignoring this one.")
+		err = errAlreadyForked
+		return
 	}
 
 	runningServersForked = true
-
-	var files = make([]*os.File, len(runningServers))
-	var orderArgs = make([]string, len(runningServers))
-	// get the accessor socket fds for _all_ server instances
-	for _, srvPtr := range runningServers {
-		// introspect.PrintTypeDump(srvPtr.EndlessListener)
-		switch srvPtr.EndlessListener.(type) {
-		case *endlessListener:
-			// normal listener
-			files[socketPtrOffsetMap[srvPtr.Server.Addr]] = srvPtr.EndlessListener.(*endlessListener).File()
-		default:
-			// tls listener
-			files[socketPtrOffsetMap[srvPtr.Server.Addr]] = srvPtr.tlsInnerListener.File()
+	restartAttempts.Add(1)
+	sdNotify("RELOADING=1")
+
+	var files []*os.File
+	var orderArgs []string
+	manifest := &handoffManifest{
+		Version:    manifestVersion,
+		Generation: generation + 1,
+		ParentPid:  syscall.Getpid(),
+	}
+	handOverTicketKeys(manifest)
+	// get the accessor socket fds for _all_ server instances. the child
+	// matches them against its own servers by name
+	for _, name := range runningServersOrder {
+		srvPtr := runningServers[name]
+		f := srvPtr.file()
+		if f == nil {
+			// not listening (yet)
+			continue
+		}
+		addr, err := socketAddress(int(f.Fd()))
+		if err != nil {
+			srvPtr.logEvent(slog.LevelError, "fork_error", "Not handing over socket", "error", err)
+			f.Close()
+			continue
+		}
+		socket := handoffSocket{
+			Fd:        3 + len(files),
+			Name:      name,
+			Network:   srvPtr.network,
+			Address:   addr,
+			Activated: srvPtr.socketActivated,
+			TLS:       srvPtr.tlsInnerListener != nil,
 		}
-		orderArgs[socketPtrOffsetMap[srvPtr.Server.Addr]] = srvPtr.Server.Addr
+		if srvPtr.certs != nil {
+			socket.Certs = srvPtr.certs.certFiles()
+		}
+		if socket.TLS {
+			socket.ClientAuth = clientAuthName(srvPtr.ClientAuth)
+		}
+		if srvPtr.clientCAs != nil {
+			socket.ClientCAs = srvPtr.clientCAs.caFiles()
+		}
+		manifest.Sockets = append(manifest.Sockets, socket)
+		files = append(files, f)
+		orderArgs = append(orderArgs, name)
 	}
 
 	env := append(
 		os.Environ(),
 		"ENDLESS_CONTINUE=1",
+		fmt.Sprintf("ENDLESS_GENERATION=%d", generation+1),
+		fmt.Sprintf("ENDLESS_SOCKET_ORDER=%s", strings.Join(orderArgs, ",")),
 	)
-	if len(runningServers) > 1 {
-		env = append(env, fmt.Sprintf(`ENDLESS_SOCKET_ORDER=%s`, strings.Join(orderArgs, ",")))
+
+	// systemd sockets no server uses. the child gets them like systemd would
+	// pass them.
+	activated, activatedEnv := unusedActivatedSockets(3 + len(files))
+	files = append(files, activated...)
+	env = append(env, activatedEnv...)
+
+	// the child reports back through this pipe once it is listening on all
+	// the sockets we hand over
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		runningServersForked = false
+		err = fmt.Errorf("Restart: Failed to create readiness pipe: %v", err)
+		return
 	}
+	files = append(files, readyW)
+	env = append(env, fmt.Sprintf("ENDLESS_READY_FD=%d", 2+len(files)))
+
+	// the child learns which socket is which from the manifest. children
+	// of older versions go by ENDLESS_SOCKET_ORDER
+	manifestR, manifestW, err := os.Pipe()
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		readyR.Close()
+		runningServersForked = false
+		err = fmt.Errorf("Restart: Failed to create manifest pipe: %v", err)
+		return
+	}
+	files = append(files, manifestR)
+	env = append(env, fmt.Sprintf("ENDLESS_MANIFEST_FD=%d", 2+len(files)))
 
 	// logPrintln(files)
 	path := os.Args[0]
@@ -526,34 +1272,229 @@ func (srv *endlessServer) fork() (err error) {
 	// }
 
 	err = cmd.Start()
+
+	// the child has its own copies of the fds now. passing them put the
+	// sockets (shared with our listeners) into blocking mode, which would
+	// keep Accept from returning on Close or deadlines
+	for _, f := range files {
+		syscall.SetNonblock(int(f.Fd()), true)
+		f.Close()
+	}
+
 	if err != nil {
-		logFatalf("Restart: Failed to launch, error: %v", err)
+		readyR.Close()
+		manifestW.Close()
+		runningServersForked = false
+		restartFailures.Add(1)
+		err = fmt.Errorf("Restart: Failed to launch, error: %v", err)
+		return
 	}
+	go writeManifest(manifestW, manifest)
+
+	logEvent(slog.LevelInfo, "fork", "Forked child", "child", cmd.Process.Pid)
+	child = &forkedChild{
+		pid:  cmd.Process.Pid,
+		done: make(chan struct{}),
+	}
+	go waitForChild(cmd, readyR, child)
 
 	return
 }
 
+/*
+waitForChild blocks until the forked child reports ready on the readiness pipe
+and then shuts down all running servers.
+
+If the child exits before it got ready or does not report ready within
+DefaultReadyTimeout the restart is rolled back.
+
+With DefaultTakeoverGraceTime set the servers are only suspended when the child
+got ready. They are shut down after the grace time, or resumed if the child
+exits before that.
+*/
+func waitForChild(cmd *exec.Cmd, readyR *os.File, child *forkedChild) {
+	pid := cmd.Process.Pid
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		defer readyR.Close()
+
+		msg, err := bufio.NewReader(readyR).ReadString('\n')
+		if err == io.EOF {
+			err = errors.New("child exited before it got ready")
+		} else if err == nil && !strings.HasPrefix(msg, "ready") {
+			err = fmt.Errorf("unexpected message from child: %q", msg)
+		}
+		ready <- err
+	}()
+
+	var timeout <-chan time.Time
+	if DefaultReadyTimeout >= 0 {
+		timer := time.NewTimer(DefaultReadyTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case err = <-ready:
+	case <-timeout:
+		err = fmt.Errorf("child did not get ready within %v", DefaultReadyTimeout)
+	}
+
+	if err != nil {
+		rollbackFork(cmd, exited, err)
+		child.err = err
+		close(child.done)
+		return
+	}
+
+	if DefaultTakeoverGraceTime <= 0 {
+		restartSuccesses.Add(1)
+		logEvent(slog.LevelInfo, "child_ready", "Child is ready. Shutting down.", "child", pid)
+		close(child.done)
+		shutdownServers()
+		return
+	}
+
+	logEvent(slog.LevelInfo, "child_ready", "Child is ready. Suspending.",
+		"child", pid, "grace", DefaultTakeoverGraceTime)
+	runningServerReg.RLock()
+	for _, srvPtr := range runningServers {
+		srvPtr.suspend()
+	}
+	runningServerReg.RUnlock()
+
+	select {
+	case <-exited:
+		logEvent(slog.LevelError, "restart_failed", "Restart failed, child exited after taking over",
+			"child", pid, "status", cmd.ProcessState)
+		resumed := false
+		runningServerReg.Lock()
+		for _, srvPtr := range runningServers {
+			if srvPtr.resume() {
+				resumed = true
+			}
+		}
+		runningServersForked = false
+		runningServerReg.Unlock()
+		restartFailures.Add(1)
+		if resumed {
+			writePidFile()
+			sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", syscall.Getpid()))
+		} else {
+			// we got told to shut down during the grace time. shutdown
+			// left this to the child, which is gone now and may have put
+			// its pid in the pid file already
+			sdNotify("STOPPING=1")
+			removePidFileOf(syscall.Getpid(), pid)
+		}
+		child.err = fmt.Errorf("child exited within the grace time: %v", cmd.ProcessState)
+		close(child.done)
+	case <-time.After(DefaultTakeoverGraceTime):
+		restartSuccesses.Add(1)
+		logEvent(slog.LevelInfo, "takeover", "Child survived the grace time. Shutting down.", "child", pid)
+		close(child.done)
+		shutdownServers()
+	}
+}
+
+/*
+shutdownServers shuts down all running servers.
+*/
+func shutdownServers() {
+	runningServerReg.RLock()
+	servers := make([]*endlessServer, 0, len(runningServers))
+	for _, srvPtr := range runningServers {
+		servers = append(servers, srvPtr)
+	}
+	runningServerReg.RUnlock()
+
+	// shutdown needs the lock itself
+	for _, srvPtr := range servers {
+		srvPtr.shutdown()
+	}
+}
+
+/*
+rollbackFork kills a child that failed to get ready and allows the servers to
+fork again. The servers never stopped serving so nothing else needs to be
+undone.
+*/
+func rollbackFork(cmd *exec.Cmd, exited chan struct{}, reason error) {
+	runningServerReg.Lock()
+	defer runningServerReg.Unlock()
+
+	pid := cmd.Process.Pid
+	for _, srvPtr := range runningServers {
+		if st := srvPtr.getState(); st == STATE_SHUTTING_DOWN || st == STATE_TERMINATE {
+			// the child told us to shut down some other way (eg. it runs an
+			// older version of endless and sent SIGTERM). it is in charge now.
+			logEvent(slog.LevelWarn, "child_not_ready", "Child did not report ready, but we are already shutting down",
+				"child", pid, "reason", reason)
+			restartSuccesses.Add(1)
+			return
+		}
+	}
+
+	logEvent(slog.LevelError, "restart_failed", "Restart failed, rolling back",
+		"child", pid, "reason", reason)
+
+	err := cmd.Process.Kill()
+	if err != nil && err != os.ErrProcessDone {
+		logEvent(slog.LevelError, "rollback", "Failed to kill child", "child", pid, "error", err)
+	}
+	<-exited
+
+	runningServersForked = false
+	restartFailures.Add(1)
+	logEvent(slog.LevelInfo, "rollback", "Child killed. Still serving.", "child", pid)
+	sdNotify("READY=1")
+}
+
 type endlessListener struct {
 	net.Listener
 	stopped bool
 	server  *endlessServer
+
+	// closed while the listener is not paused
+	unpaused  chan struct{}
+	pauseLock sync.Mutex
 }
 
 func (el *endlessListener) Accept() (c net.Conn, err error) {
-	tc, err := el.Listener.(*net.TCPListener).AcceptTCP()
-	if err != nil {
-		return
+	var nc net.Conn
+	for {
+		<-el.waitUnpaused()
+
+		nc, err = el.Listener.Accept()
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) || !el.paused() {
+			return
+		}
+		// got kicked out of Accept by pause()
 	}
 
-	tc.SetKeepAlive(true)                  // see http.tcpKeepAliveListener
-	tc.SetKeepAlivePeriod(3 * time.Minute) // see http.tcpKeepAliveListener
+	if tc, ok := nc.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)                  // see http.tcpKeepAliveListener
+		tc.SetKeepAlivePeriod(3 * time.Minute) // see http.tcpKeepAliveListener
+	}
 
-	c = endlessConn{
-		Conn:   tc,
+	ec := &endlessConn{
+		Conn:   nc,
 		server: el.server,
 	}
+	el.server.addConn(ec)
 
-	el.server.wg.Add(1)
+	c = ec
 	return
 }
 
@@ -561,7 +1502,9 @@ func newEndlessListener(l net.Listener, srv *endlessServer) (el *endlessListener
 	el = &endlessListener{
 		Listener: l,
 		server:   srv,
+		unpaused: make(chan struct{}),
 	}
+	close(el.unpaused)
 
 	return
 }
@@ -572,27 +1515,176 @@ func (el *endlessListener) Close() error {
 	}
 
 	el.stopped = true
+	el.resume()
 	return el.Listener.Close()
 }
 
+/*
+pause makes Accept block without closing the socket. Connections queue up in
+the backlog (or get accepted by another process sharing the socket) until
+resume is called.
+*/
+func (el *endlessListener) pause() {
+	el.pauseLock.Lock()
+	defer el.pauseLock.Unlock()
+
+	select {
+	case <-el.unpaused:
+		el.unpaused = make(chan struct{})
+	default:
+		return
+	}
+
+	// kick a pending Accept out of the accept syscall
+	el.Listener.(deadlineListener).SetDeadline(time.Now())
+}
+
+func (el *endlessListener) resume() {
+	el.pauseLock.Lock()
+	defer el.pauseLock.Unlock()
+
+	select {
+	case <-el.unpaused:
+		return
+	default:
+	}
+
+	el.Listener.(deadlineListener).SetDeadline(time.Time{})
+	close(el.unpaused)
+}
+
+func (el *endlessListener) paused() bool {
+	select {
+	case <-el.waitUnpaused():
+		return false
+	default:
+		return true
+	}
+}
+
+func (el *endlessListener) waitUnpaused() <-chan struct{} {
+	el.pauseLock.Lock()
+	defer el.pauseLock.Unlock()
+
+	return el.unpaused
+}
+
 func (el *endlessListener) File() *os.File {
 	// returns a dup(2) - FD_CLOEXEC flag *not* set
-	tl := el.Listener.(*net.TCPListener)
+	tl := el.Listener.(filer)
 	fl, _ := tl.File()
 	return fl
 }
 
+// implemented by *net.TCPListener and *net.UnixListener
+type deadlineListener interface {
+	SetDeadline(t time.Time) error
+}
+
+// implemented by *net.TCPListener, *net.UnixListener and *net.UDPConn
+type filer interface {
+	File() (f *os.File, err error)
+}
+
 type endlessConn struct {
 	net.Conn
-	server *endlessServer
+	server    *endlessServer
+	closeOnce sync.Once
+}
+
+func (w *endlessConn) Close() (err error) {
+	err = syscall.EINVAL
+	w.closeOnce.Do(func() {
+		err = w.Conn.Close()
+		w.server.removeConn(w)
+	})
+	return
+}
+
+func (srv *endlessServer) addConn(c *endlessConn) {
+	srv.connsLock.Lock()
+	defer srv.connsLock.Unlock()
+
+	srv.conns[c] = http.StateNew
+	srv.wg.Add(1)
+	srv.metrics.accepted.Add(1)
+}
+
+func (srv *endlessServer) removeConn(c *endlessConn) {
+	srv.connsLock.Lock()
+	defer srv.connsLock.Unlock()
+
+	if _, ok := srv.conns[c]; ok {
+		delete(srv.conns, c)
+		srv.wg.Done()
+		srv.metrics.closed.Add(1)
+	}
+}
+
+/*
+trackConnState records the state http.Server reports for a connection.
+*/
+func (srv *endlessServer) trackConnState(c net.Conn, st http.ConnState) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if hc, ok := c.(*h2cConn); ok {
+		c = hc.Conn
+	}
+	ec, ok := c.(*endlessConn)
+	if !ok {
+		return
+	}
+
+	srv.connsLock.Lock()
+	defer srv.connsLock.Unlock()
+
+	if _, ok := srv.conns[ec]; ok && st != http.StateClosed {
+		srv.conns[ec] = st
+	}
 }
 
-func (w endlessConn) Close() error {
-	err := w.Conn.Close()
-	if err == nil {
-		w.server.wg.Done()
+func (srv *endlessServer) activeConns() int {
+	srv.connsLock.Lock()
+	defer srv.connsLock.Unlock()
+
+	return len(srv.conns)
+}
+
+/*
+closeIdleConns closes the connections that are waiting for the next request.
+*/
+func (srv *endlessServer) closeIdleConns() {
+	srv.closeConnsIf(func(st http.ConnState) bool {
+		return st == http.StateIdle
+	})
+}
+
+/*
+closeConns closes all connections, no matter what they are doing.
+*/
+func (srv *endlessServer) closeConns() {
+	n := srv.closeConnsIf(func(st http.ConnState) bool {
+		return true
+	})
+	srv.metrics.hammered.Add(int64(n))
+}
+
+func (srv *endlessServer) closeConnsIf(match func(st http.ConnState) bool) int {
+	srv.connsLock.Lock()
+	var conns []*endlessConn
+	for c, st := range srv.conns {
+		if match(st) {
+			conns = append(conns, c)
+		}
+	}
+	srv.connsLock.Unlock()
+
+	// Close needs the lock
+	for _, c := range conns {
+		c.Close()
 	}
-	return err
+	return len(conns)
 }
 
 /*
@@ -0,0 +1,965 @@
+package endless
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/*
+resetProcess makes the process look like a freshly started one without any
+servers, and puts the process wide state back when t is done.
+*/
+func resetProcess(t *testing.T) {
+	runningServerReg.Lock()
+	servers, order, forked := runningServers, runningServersOrder, runningServersForked
+	inherited, loaded, timerStarted := inheritedSockets, inheritedLoaded, unclaimedTimerStarted
+	pipe, notified, listening := readyPipe, parentNotified, listeningSockets
+	runningServers = make(map[string]*endlessServer)
+	runningServersOrder = []string{}
+	runningServersForked = false
+	inheritedSockets = make(map[string]*inheritedSocket)
+	inheritedLoaded, unclaimedTimerStarted = false, false
+	readyPipe, parentNotified, listeningSockets = nil, false, 0
+	runningServerReg.Unlock()
+
+	child, gen, order0 := isChild, generation, socketOrder
+	ready := processReady
+	processReady = make(chan struct{})
+	processReadyOnce = sync.Once{}
+
+	hammer, readyTimeout := DefaultHammerTime, DefaultReadyTimeout
+	grace, unclaimed := DefaultTakeoverGraceTime, DefaultUnclaimedTimeout
+	pidFile := PidFile
+	// nothing gets hammered or closed behind the back of a test
+	DefaultHammerTime = -1
+	DefaultUnclaimedTimeout = -1
+
+	t.Cleanup(func() {
+		runningServerReg.Lock()
+		runningServers, runningServersOrder, runningServersForked = servers, order, forked
+		inheritedSockets, inheritedLoaded, unclaimedTimerStarted = inherited, loaded, timerStarted
+		readyPipe, parentNotified, listeningSockets = pipe, notified, listening
+		runningServerReg.Unlock()
+
+		isChild, generation, socketOrder = child, gen, order0
+		processReady = ready
+		processReadyOnce = sync.Once{}
+		select {
+		case <-ready:
+			processReadyOnce.Do(func() {})
+		default:
+		}
+
+		DefaultHammerTime, DefaultReadyTimeout = hammer, readyTimeout
+		DefaultTakeoverGraceTime, DefaultUnclaimedTimeout = grace, unclaimed
+		PidFile = pidFile
+	})
+}
+
+/*
+newListeningServer registers a server called name that listens on a free port
+of 127.0.0.1 and is running, as if Serve had been called.
+*/
+func newListeningServer(t *testing.T, name string) *endlessServer {
+	srv := newServer("tcp", name, "127.0.0.1:0", nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	srv.EndlessListener = newEndlessListener(l, srv)
+	srv.setState(STATE_RUNNING)
+	return srv
+}
+
+/*
+startChild runs script with sh like a forked child, with the write end of a
+readiness pipe as fd 3. It returns the read end.
+*/
+func startChild(t *testing.T, script string) (*exec.Cmd, *os.File) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.ExtraFiles = []*os.File{w}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		r.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+	return cmd, r
+}
+
+/*
+watchChild runs waitForChild for cmd, as fork does.
+*/
+func watchChild(cmd *exec.Cmd, readyR *os.File) *forkedChild {
+	runningServerReg.Lock()
+	runningServersForked = true
+	runningServerReg.Unlock()
+
+	child := &forkedChild{pid: cmd.Process.Pid, done: make(chan struct{})}
+	go waitForChild(cmd, readyR, child)
+	return child
+}
+
+/*
+waitDecided waits until waitForChild decided about child.
+*/
+func waitDecided(t *testing.T, child *forkedChild) {
+	t.Helper()
+	select {
+	case <-child.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("waitForChild did not decide about the child")
+	}
+}
+
+func isReady() bool {
+	select {
+	case <-processReady:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestChildNotifiesParentOnceReady(t *testing.T) {
+	resetProcess(t)
+	isChild = true
+	// as if loadInheritedSockets had run. a child without a readiness pipe
+	// would send SIGTERM to its parent, the test runner
+	inheritedLoaded = true
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	readyPipe = w
+
+	// a socket of the parent no server takes over
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inheritedSockets["gone"] = &inheritedSocket{fd: fd}
+
+	srv1 := newListeningServer(t, "one")
+	srv2 := newListeningServer(t, "two")
+
+	// nothing can be read while the pipe stays open
+	notNotified := func(step string) {
+		t.Helper()
+		buf := make([]byte, 64)
+		r.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if n, err := r.Read(buf); err == nil {
+			t.Fatalf("parent notified %s: %q", step, buf[:n])
+		}
+		if isReady() {
+			t.Fatalf("ready %s", step)
+		}
+	}
+
+	srv1.listening()
+	notNotified("with one of two servers listening")
+	srv2.listening()
+	notNotified("with an inherited socket left")
+
+	closeUnclaimedSockets()
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("ready %d\n", syscall.Getpid()); string(msg) != want {
+		t.Errorf("parent got %q, want %q", msg, want)
+	}
+	if !isReady() {
+		t.Error("not ready after notifying the parent")
+	}
+	if len(inheritedSockets) != 0 {
+		t.Errorf("inherited sockets left: %v", inheritedSockets)
+	}
+}
+
+func TestNotForkedReadyOnceAllListen(t *testing.T) {
+	resetProcess(t)
+
+	srv1 := newListeningServer(t, "one")
+	srv2 := newListeningServer(t, "two")
+
+	srv1.listening()
+	if isReady() {
+		t.Fatal("ready with one of two servers listening")
+	}
+	srv2.listening()
+	if !isReady() {
+		t.Fatal("not ready with all servers listening")
+	}
+}
+
+func TestWaitForChildShutsDownOnceReady(t *testing.T) {
+	resetProcess(t)
+	DefaultTakeoverGraceTime = 0
+	srv := newListeningServer(t, "srv")
+
+	cmd, readyR := startChild(t, "sleep 0.3; echo ready $$ >&3; sleep 10")
+	successes := restartSuccesses.Load()
+
+	child := watchChild(cmd, readyR)
+
+	time.Sleep(100 * time.Millisecond)
+	if st := srv.getState(); st != STATE_RUNNING {
+		t.Fatalf("state %s before the child got ready", stateName(st))
+	}
+
+	waitDecided(t, child)
+	if child.err != nil {
+		t.Fatalf("child failed: %v", child.err)
+	}
+	if st := srv.getState(); st != STATE_SHUTTING_DOWN {
+		t.Errorf("state %s after the child got ready", stateName(st))
+	}
+	if got := restartSuccesses.Load() - successes; got != 1 {
+		t.Errorf("%d restart successes, want 1", got)
+	}
+	if !handedOver() {
+		t.Error("not handed over to the child")
+	}
+}
+
+func TestWaitForChildRollsBack(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		wantErr string
+	}{
+		{"exits", "exit 3", time.Minute, "child exited before it got ready"},
+		{"closes the pipe", "exec 3>&-; sleep 10", time.Minute, "child exited before it got ready"},
+		{"garbage", "echo hello >&3; sleep 10", time.Minute, `unexpected message from child: "hello\n"`},
+		{"hangs", "sleep 10", 200 * time.Millisecond, "child did not get ready within 200ms"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetProcess(t)
+			DefaultReadyTimeout = tt.timeout
+			srv := newListeningServer(t, "srv")
+			failures := restartFailures.Load()
+
+			cmd, readyR := startChild(t, tt.script)
+			child := watchChild(cmd, readyR)
+			waitDecided(t, child)
+
+			if child.err == nil || child.err.Error() != tt.wantErr {
+				t.Errorf("child error %v, want %s", child.err, tt.wantErr)
+			}
+			if handedOver() {
+				t.Error("still forked, can't restart again")
+			}
+			if st := srv.getState(); st != STATE_RUNNING {
+				t.Errorf("state %s, want running", stateName(st))
+			}
+			if got := restartFailures.Load() - failures; got != 1 {
+				t.Errorf("%d restart failures, want 1", got)
+			}
+			// the child is not left running
+			if cmd.ProcessState == nil || cmd.ProcessState.Success() {
+				t.Errorf("child not killed: %v", cmd.ProcessState)
+			}
+		})
+	}
+}
+
+func TestRollbackWhileShuttingDown(t *testing.T) {
+	resetProcess(t)
+	srv := newListeningServer(t, "srv")
+	successes := restartSuccesses.Load()
+
+	// an older child sends SIGTERM instead of reporting ready
+	srv.shutdown()
+	cmd, readyR := startChild(t, "exit 0")
+	child := watchChild(cmd, readyR)
+	waitDecided(t, child)
+
+	if !handedOver() {
+		t.Error("not handed over, the child is in charge")
+	}
+	if got := restartSuccesses.Load() - successes; got != 1 {
+		t.Errorf("%d restart successes, want 1", got)
+	}
+}
+
+/*
+serveTestServer serves handler on a free port of 127.0.0.1 and returns the
+server once it is serving. What ListenAndServe returned can be read from the
+channel. The server is closed when t is done.
+*/
+func serveTestServer(t *testing.T, handler http.Handler) (*endlessServer, <-chan error) {
+	srv := NewServer("127.0.0.1:0", handler)
+	return srv, startTestServer(t, srv)
+}
+
+/*
+startTestServer is serveTestServer for a server made by the test.
+*/
+func startTestServer(t *testing.T, srv *endlessServer) <-chan error {
+	serving := make(chan struct{})
+	srv.onServe = func() { close(serving) }
+
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		errc <- srv.ListenAndServe()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		signal.Stop(srv.sigChan)
+		srv.Close()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Error("server did not stop")
+		}
+	})
+
+	select {
+	case <-serving:
+	case err := <-errc:
+		t.Fatal(err)
+	}
+	return errc
+}
+
+/*
+get sends a HTTP/1.0 request for path to addr and returns the response, or an
+error if there is none within d.
+*/
+func get(addr, path string, d time.Duration) (string, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(d))
+	fmt.Fprintf(c, "GET %s HTTP/1.0\r\n\r\n", path)
+	b, err := io.ReadAll(c)
+	return string(b), err
+}
+
+func TestSuspendResume(t *testing.T) {
+	resetProcess(t)
+	srv, _ := serveTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	addr := srv.EndlessListener.Addr().String()
+
+	if resp, err := get(addr, "/", time.Second); err != nil || !strings.HasSuffix(resp, "hello") {
+		t.Fatalf("before suspend: %q, %v", resp, err)
+	}
+
+	srv.suspend()
+	if st := srv.getState(); st != STATE_SUSPENDED {
+		t.Fatalf("state %s after suspend", stateName(st))
+	}
+	if resp, err := get(addr, "/", 200*time.Millisecond); err == nil {
+		t.Fatalf("served while suspended: %q", resp)
+	}
+
+	// connections wait in the backlog meanwhile
+	pending := make(chan error, 1)
+	go func() {
+		resp, err := get(addr, "/", 5*time.Second)
+		if err == nil && !strings.HasSuffix(resp, "hello") {
+			err = fmt.Errorf("response %q", resp)
+		}
+		pending <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if !srv.resume() {
+		t.Fatal("resume did not resume")
+	}
+	if err := <-pending; err != nil {
+		t.Fatalf("connection made while suspended: %v", err)
+	}
+	if srv.resume() {
+		t.Error("resumed twice")
+	}
+}
+
+func TestTakeoverGraceTime(t *testing.T) {
+	tests := []struct {
+		name string
+		// the child reports ready, then runs script
+		script string
+		// shut down while the servers are suspended
+		shutdown bool
+
+		wantErr   string
+		wantState uint8
+		// whose pid the pid file holds afterwards, empty for none
+		wantPidFile string
+		wantNotify  []string
+	}{
+		{
+			name:        "child survives",
+			script:      "sleep 10",
+			wantState:   STATE_SHUTTING_DOWN,
+			wantPidFile: "child",
+		},
+		{
+			name:        "child dies",
+			script:      "sleep 0.3; exit 1",
+			wantErr:     "child exited within the grace time: exit status 1",
+			wantState:   STATE_RUNNING,
+			wantPidFile: "parent",
+			wantNotify:  []string{"MAINPID=parent\nREADY=1"},
+		},
+		{
+			name:       "child dies while shutting down",
+			script:     "sleep 0.3; exit 1",
+			shutdown:   true,
+			wantErr:    "child exited within the grace time: exit status 1",
+			wantState:  STATE_SHUTTING_DOWN,
+			wantNotify: []string{"STOPPING=1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetProcess(t)
+			DefaultTakeoverGraceTime = time.Second
+			srv := newListeningServer(t, "srv")
+			notified := listenNotify(t)
+
+			cmd, readyR := startChild(t, "echo ready $$ >&3; "+tt.script)
+			pids := map[string]string{
+				"parent": strconv.Itoa(syscall.Getpid()),
+				"child":  strconv.Itoa(cmd.Process.Pid),
+			}
+			// the child got ready, so it wrote the pid file
+			PidFile = filepath.Join(t.TempDir(), "pid")
+			os.WriteFile(PidFile, []byte(pids["child"]+"\n"), 0644)
+
+			child := watchChild(cmd, readyR)
+			if tt.shutdown {
+				waitState(t, srv, STATE_SUSPENDED)
+				srv.shutdown()
+			}
+			waitDecided(t, child)
+
+			if tt.wantErr == "" {
+				if child.err != nil {
+					t.Errorf("child error %v", child.err)
+				}
+			} else if child.err == nil || child.err.Error() != tt.wantErr {
+				t.Errorf("child error %v, want %s", child.err, tt.wantErr)
+			}
+			if tt.wantState == STATE_RUNNING {
+				if handedOver() {
+					t.Error("still forked, can't restart again")
+				}
+			}
+			if st := srv.getState(); st != tt.wantState {
+				t.Errorf("state %s, want %s", stateName(st), stateName(tt.wantState))
+			}
+
+			b, err := os.ReadFile(PidFile)
+			if tt.wantPidFile == "" {
+				if err == nil {
+					t.Errorf("pid file left with %q", b)
+				}
+			} else if want := pids[tt.wantPidFile] + "\n"; string(b) != want {
+				t.Errorf("pid file %q, %v, want %q", b, err, want)
+			}
+
+			var want []string
+			for _, n := range tt.wantNotify {
+				want = append(want, strings.Replace(n, "parent", pids["parent"], 1))
+			}
+			if got := notified(); !slices.Equal(got, want) {
+				t.Errorf("notified %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+/*
+listenNotify makes sdNotify send to a socket of its own. The returned function
+returns what was sent so far.
+*/
+func listenNotify(t *testing.T) func() []string {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "")
+	enabled := EnableSdNotify
+	EnableSdNotify = true
+	t.Cleanup(func() { EnableSdNotify = enabled })
+
+	return func() (states []string) {
+		buf := make([]byte, 1024)
+		for {
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			states = append(states, string(buf[:n]))
+		}
+	}
+}
+
+/*
+waitState waits until srv is in state st.
+*/
+func waitState(t *testing.T, srv *endlessServer, st uint8) {
+	t.Helper()
+	for i := 0; srv.getState() != st; i++ {
+		if i == 500 {
+			t.Fatalf("state %s, waiting for %s", stateName(srv.getState()), stateName(st))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/*
+connTestServer serves "hello" on / and on /slow starts responding once release
+is closed. Requests to /slow are announced on started.
+*/
+func connTestServer(t *testing.T) (srv *endlessServer, errc <-chan error, started chan struct{}, release chan struct{}) {
+	started = make(chan struct{}, 10)
+	release = make(chan struct{})
+	srv, errc = serveTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		io.WriteString(w, "hello")
+	}))
+	return
+}
+
+/*
+request sends a HTTP/1.1 request for path on c, which stays open.
+*/
+func request(c net.Conn, path string) (string, error) {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "GET %s HTTP/1.1\r\nHost: test\r\n\r\n", path)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+/*
+idleConn opens a connection to srv and makes a request on it, so that it is
+idle in a keep-alive afterwards.
+*/
+func idleConn(t *testing.T, srv *endlessServer) net.Conn {
+	c, err := net.Dial("tcp", srv.EndlessListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if body, err := request(c, "/"); err != nil || body != "hello" {
+		t.Fatalf("request: %q, %v", body, err)
+	}
+
+	// the state changes after the response went out
+	for i := 0; ; i++ {
+		srv.connsLock.Lock()
+		idle := 0
+		for _, st := range srv.conns {
+			if st == http.StateIdle {
+				idle++
+			}
+		}
+		srv.connsLock.Unlock()
+		if idle > 0 {
+			return c
+		}
+		if i == 500 {
+			t.Fatal("connection does not get idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/*
+slowConn starts a request for /slow, its response can be read from the
+returned channel.
+*/
+func slowConn(t *testing.T, srv *endlessServer, started chan struct{}) (net.Conn, <-chan error) {
+	c, err := net.Dial("tcp", srv.EndlessListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	done := make(chan error, 1)
+	go func() {
+		body, err := request(c, "/slow")
+		if err == nil && body != "hello" {
+			err = fmt.Errorf("response %q", body)
+		}
+		done <- err
+	}()
+	<-started
+	return c, done
+}
+
+/*
+closed tells whether c got closed by the server within d.
+*/
+func closed(c net.Conn, d time.Duration) bool {
+	c.SetReadDeadline(time.Now().Add(d))
+	_, err := c.Read(make([]byte, 1))
+	return err == io.EOF || errors.Is(err, syscall.ECONNRESET)
+}
+
+func TestShutdownWaitsForActiveConns(t *testing.T) {
+	resetProcess(t)
+	srv, errc, started, release := connTestServer(t)
+	idle := idleConn(t, srv)
+	_, slow := slowConn(t, srv, started)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+
+	if !closed(idle, time.Second) {
+		t.Error("idle connection not closed")
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned with an active connection: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := srv.activeConns(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("active connection: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	select {
+	case <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return")
+	}
+	if n := srv.activeConns(); n != 0 {
+		t.Errorf("%d connections left", n)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	resetProcess(t)
+	srv, errc, started, _ := connTestServer(t)
+	slowC, slow := slowConn(t, srv, started)
+	hammered := srv.metrics.hammered.Load()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if !closed(slowC, time.Second) {
+		t.Error("active connection not closed")
+	}
+	if err := <-slow; err == nil {
+		t.Error("active connection got a response")
+	}
+	select {
+	case <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return")
+	}
+	if got := srv.metrics.hammered.Load() - hammered; got != 1 {
+		t.Errorf("%d connections hammered, want 1", got)
+	}
+}
+
+func TestClose(t *testing.T) {
+	resetProcess(t)
+	srv, errc, started, _ := connTestServer(t)
+	idle := idleConn(t, srv)
+	slowC, _ := slowConn(t, srv, started)
+
+	srv.Close()
+	if !closed(idle, time.Second) {
+		t.Error("idle connection not closed")
+	}
+	if !closed(slowC, time.Second) {
+		t.Error("active connection not closed")
+	}
+	select {
+	case <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return")
+	}
+	if n := srv.activeConns(); n != 0 {
+		t.Errorf("%d connections left", n)
+	}
+}
+
+/*
+inheritSocket makes a listening socket of network ("tcp" or "unix") as if it was
+passed by the parent, and returns its fd and the address it is bound to.
+*/
+func inheritSocket(t *testing.T, network string) (int, string) {
+	addr := "127.0.0.1:0"
+	if network == "unix" {
+		addr = filepath.Join(t.TempDir(), "s.sock")
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	f, err := l.(filer).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err = socketAddress(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd, addr
+}
+
+func TestClaimInheritedSocketByName(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		// the socket the parent passed as "api"
+		inherited func(fd int, addr string) *inheritedSocket
+		wantErr   string
+	}{
+		{
+			name:    "moved elsewhere",
+			network: "tcp",
+			inherited: func(fd int, addr string) *inheritedSocket {
+				return &inheritedSocket{fd: fd, network: "tcp", address: addr}
+			},
+		},
+		{
+			name:    "ENDLESS_SOCKET_ORDER",
+			network: "tcp",
+			inherited: func(fd int, addr string) *inheritedSocket {
+				return &inheritedSocket{fd: fd}
+			},
+		},
+		{
+			name:    "other network",
+			network: "unix",
+			inherited: func(fd int, addr string) *inheritedSocket {
+				return &inheritedSocket{fd: fd, network: "tcp", address: addr}
+			},
+			wantErr: "inherited socket api: it is a tcp socket, not unix",
+		},
+		{
+			name:    "failed the checks",
+			network: "tcp",
+			inherited: func(fd int, addr string) *inheritedSocket {
+				return &inheritedSocket{fd: fd, network: "tcp", address: addr,
+					err: errors.New("fd 3 is bound to somewhere else")}
+			},
+			wantErr: "inherited socket api: fd 3 is bound to somewhere else",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetProcess(t)
+			fd, addr := inheritSocket(t, "tcp")
+			inheritedSockets["api"] = tt.inherited(fd, addr)
+
+			// not where the parent listened
+			srv := newServer(tt.network, "api", "127.0.0.1:1", nil)
+			f, err := srv.claimInheritedSocket(srv.Addr)
+			if f != nil {
+				defer f.Close()
+			}
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr || f != nil {
+					t.Fatalf("claimed %v, %v, want error %s", f, err, tt.wantErr)
+				}
+			} else {
+				if err != nil || f == nil {
+					t.Fatalf("claimed %v, %v", f, err)
+				}
+				if got, _ := socketAddress(int(f.Fd())); got != addr {
+					t.Errorf("claimed socket bound to %s, want %s", got, addr)
+				}
+			}
+
+			// only once
+			if f, err := srv.claimInheritedSocket(srv.Addr); f != nil || err != nil {
+				t.Errorf("claimed again: %v, %v", f, err)
+			}
+		})
+	}
+}
+
+func TestUniqueServerName(t *testing.T) {
+	resetProcess(t)
+
+	var names []string
+	for _, name := range []string{"api", "api", "", "api"} {
+		names = append(names, newServer("tcp", name, "127.0.0.1:8080", nil).name)
+	}
+	want := []string{"api", "api#2", "127.0.0.1:8080", "api#3"}
+	if !slices.Equal(names, want) {
+		t.Errorf("names %q, want %q", names, want)
+	}
+	if !slices.Equal(runningServersOrder, want) {
+		t.Errorf("running servers %q, want %q", runningServersOrder, want)
+	}
+}
+
+func TestClaimInheritedSocketByAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		// the address the server listens on, given the one of the socket
+		laddr func(addr string) string
+		// how the parent described the socket
+		legacy, failed bool
+		wantClaimed    bool
+	}{
+		{name: "same", network: "tcp", laddr: func(addr string) string { return addr }, wantClaimed: true},
+		{name: "any host", network: "tcp", laddr: func(addr string) string { return ":" + port(addr) }, wantClaimed: true},
+		{name: "hostname", network: "tcp", laddr: func(addr string) string { return "localhost:" + port(addr) }, wantClaimed: true},
+		{name: "unix", network: "unix", laddr: func(addr string) string { return addr }, wantClaimed: true},
+		{name: "other port", network: "tcp", laddr: func(addr string) string { return "127.0.0.1:1" }},
+		{name: "other path", network: "unix", laddr: func(addr string) string { return addr + ".new" }},
+		{name: "ENDLESS_SOCKET_ORDER", network: "tcp", laddr: func(addr string) string { return addr }, legacy: true},
+		{name: "failed the checks", network: "tcp", laddr: func(addr string) string { return addr }, failed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetProcess(t)
+			fd, addr := inheritSocket(t, tt.network)
+			is := &inheritedSocket{fd: fd, network: tt.network, address: addr}
+			if tt.legacy {
+				is = &inheritedSocket{fd: fd}
+			}
+			if tt.failed {
+				is.err = errors.New("failed")
+			}
+			inheritedSockets["old"] = is
+			defer func() {
+				if _, ok := inheritedSockets["old"]; ok {
+					syscall.Close(fd)
+				}
+			}()
+
+			srv := newServer(tt.network, "new", tt.laddr(addr), nil)
+			f, err := srv.claimInheritedSocket(srv.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f != nil {
+				defer f.Close()
+			}
+			if claimed := f != nil; claimed != tt.wantClaimed {
+				t.Fatalf("claimed %v, want %v", claimed, tt.wantClaimed)
+			}
+			if _, left := inheritedSockets["old"]; left == tt.wantClaimed {
+				t.Errorf("socket left over %v, want %v", left, !tt.wantClaimed)
+			}
+		})
+	}
+}
+
+func port(addr string) string {
+	_, p, _ := net.SplitHostPort(addr)
+	return p
+}
+
+func TestUnclaimedSocketsClosedOnceAllListen(t *testing.T) {
+	resetProcess(t)
+	// the test closes them itself, not some goroutine that outlives it
+	DefaultUnclaimedTimeout = time.Hour
+	fd, _ := inheritSocket(t, "tcp")
+	inheritedSockets["gone"] = &inheritedSocket{fd: fd}
+
+	srv1 := newListeningServer(t, "one")
+	srv2 := newListeningServer(t, "two")
+
+	// the second server may still take it over
+	srv1.listening()
+	if unclaimedTimerStarted {
+		t.Fatal("countdown started with one of two servers listening")
+	}
+	srv2.listening()
+	if !unclaimedTimerStarted {
+		t.Fatal("countdown not started with all servers listening")
+	}
+	if isReady() {
+		t.Fatal("ready with an inherited socket left")
+	}
+
+	closeUnclaimedSockets()
+	if !isReady() {
+		t.Error("not ready after the unclaimed socket got closed")
+	}
+	if len(inheritedSockets) != 0 {
+		t.Errorf("%d inherited sockets left", len(inheritedSockets))
+	}
+	if _, err := syscall.Getsockname(fd); err != syscall.EBADF {
+		t.Errorf("socket still open: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+
+	"github.com/bsc-s2/endless"
+)
+
+func echo(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		c.Write(line)
+	}
+}
+
+func main() {
+	l, err := endless.Listen("tcp", "localhost:4245")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Println(err)
+			break
+		}
+		go echo(c)
+	}
+
+	l.Wait()
+	log.Println("Server on 4245 stopped")
+
+	os.Exit(0)
+}
@@ -0,0 +1,342 @@
+package endless
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// the connection preface every HTTP/2 client starts with
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// the largest frame a peer has to accept before it said otherwise
+const http2MaxFrameSize = 16384
+
+// HTTP/2 frame types and flags
+const (
+	frameHeaders  = 0x1
+	frameSettings = 0x4
+	flagAck       = 0x1
+	flagEndStream = 0x1
+	flagEndHeader = 0x4
+)
+
+/*
+h2cUpgradeHandler switches HTTP/1.1 connections that ask for it with
+"Upgrade: h2c" to HTTP/2 and passes all other requests on to next.
+
+net/http only serves h2c to clients that start with the HTTP/2 preface. For an
+upgrade the request is turned into the frames such a client would have sent
+(the preface, its settings from the HTTP2-Settings header and the request as
+stream 1) and the hijacked connection is served by an http.Server that only
+speaks h2c. Like any HTTP/2 connection it answers the request on stream 1, then
+goes on with what the client sends after its own preface.
+*/
+type h2cUpgradeHandler struct {
+	srv  *endlessServer
+	next http.Handler
+}
+
+func (h *h2cUpgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	next := h.next
+	if next == nil {
+		next = http.DefaultServeMux
+	}
+
+	frames, ok := h2cUpgradeFrames(r)
+	if !ok || h.srv.getState() != STATE_RUNNING {
+		// stay on HTTP/1.1, a server may ignore Upgrade
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	h.srv.serveH2C(&h2cConn{
+		Conn:   conn,
+		r:      io.MultiReader(bytes.NewReader(frames), &prefaceReader{r: rw.Reader}),
+		closed: make(chan struct{}),
+	}, next)
+}
+
+/*
+serveH2C serves the upgraded connection c with HTTP/2 until it is closed. The
+server doing that is shut down along with srv, see goAway.
+*/
+func (srv *endlessServer) serveH2C(c *h2cConn, handler http.Handler) {
+	h2srv := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       srv.ReadTimeout,
+		ReadHeaderTimeout: srv.ReadHeaderTimeout,
+		WriteTimeout:      srv.WriteTimeout,
+		IdleTimeout:       srv.IdleTimeout,
+		MaxHeaderBytes:    srv.MaxHeaderBytes,
+		ErrorLog:          srv.ErrorLog,
+		HTTP2:             srv.HTTP2,
+		Protocols:         new(http.Protocols),
+		ConnState: func(c net.Conn, st http.ConnState) {
+			srv.trackConnState(c, st)
+		},
+	}
+	h2srv.Protocols.SetUnencryptedHTTP2(true)
+
+	srv.connsLock.Lock()
+	if srv.h2cServers == nil {
+		srv.h2cServers = make(map[*http.Server]struct{})
+	}
+	srv.h2cServers[h2srv] = struct{}{}
+	srv.connsLock.Unlock()
+
+	l := &h2cListener{conn: c, done: make(chan struct{})}
+	h2srv.Serve(l)
+
+	srv.connsLock.Lock()
+	delete(srv.h2cServers, h2srv)
+	srv.connsLock.Unlock()
+
+	if !l.accepted {
+		// shut down before it got to serve
+		c.Close()
+	}
+}
+
+/*
+h2cUpgradeFrames returns the HTTP/2 frames that stand for r, an HTTP/1.1
+request asking to upgrade to h2c, or false if r can't be upgraded. Requests
+with a body are not upgraded, as their body would have to obey HTTP/2 flow
+control.
+*/
+func h2cUpgradeFrames(r *http.Request) ([]byte, bool) {
+	if r.ProtoMajor != 1 || !headerHasToken(r.Header, "Upgrade", "h2c") ||
+		!headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Connection", "http2-settings") {
+		return nil, false
+	}
+	if r.ContentLength != 0 || len(r.TransferEncoding) > 0 || !strings.HasPrefix(r.RequestURI, "/") {
+		return nil, false
+	}
+
+	values := r.Header.Values("HTTP2-Settings")
+	if len(values) != 1 {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+	if err != nil || len(settings)%6 != 0 || len(settings) > http2MaxFrameSize {
+		return nil, false
+	}
+
+	block := hpackLiteral(nil, ":method", r.Method)
+	block = hpackLiteral(block, ":scheme", "http")
+	block = hpackLiteral(block, ":authority", r.Host)
+	block = hpackLiteral(block, ":path", r.RequestURI)
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		switch name {
+		case "connection", "upgrade", "http2-settings", "keep-alive", "proxy-connection",
+			"transfer-encoding", "te", "host":
+			// connection specific, not allowed in HTTP/2
+			continue
+		}
+		for _, v := range values {
+			block = hpackLiteral(block, name, v)
+		}
+	}
+	if len(block) > http2MaxFrameSize {
+		return nil, false
+	}
+
+	frames := []byte(http2Preface)
+	frames = appendFrame(frames, frameSettings, 0, 0, settings)
+	frames = appendFrame(frames, frameHeaders, flagEndStream|flagEndHeader, 1, block)
+	return frames, true
+}
+
+func appendFrame(b []byte, typ, flags byte, stream uint32, payload []byte) []byte {
+	n := len(payload)
+	b = append(b, byte(n>>16), byte(n>>8), byte(n), typ, flags)
+	b = binary.BigEndian.AppendUint32(b, stream)
+	return append(b, payload...)
+}
+
+/*
+hpackLiteral appends the header field name: value to the HPACK block b, as a
+literal that does not go into the dynamic table and without Huffman coding.
+*/
+func hpackLiteral(b []byte, name, value string) []byte {
+	b = append(b, 0)
+	b = hpackInt(b, 7, uint64(len(name)))
+	b = append(b, name...)
+	b = hpackInt(b, 7, uint64(len(value)))
+	return append(b, value...)
+}
+
+func hpackInt(b []byte, prefix uint, i uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if i < max {
+		return append(b, byte(i))
+	}
+	b = append(b, byte(max))
+	for i -= max; i >= 0x80; i >>= 7 {
+		b = append(b, byte(i&0x7f|0x80))
+	}
+	return append(b, byte(i))
+}
+
+/*
+headerHasToken tells whether one of the comma separated values of the header
+key is token, ignoring case.
+*/
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+prefaceReader reads from r after making sure it starts with the HTTP/2 preface,
+which it skips.
+*/
+type prefaceReader struct {
+	r    io.Reader
+	seen bool
+}
+
+func (pr *prefaceReader) Read(p []byte) (int, error) {
+	if !pr.seen {
+		b := make([]byte, len(http2Preface))
+		_, err := io.ReadFull(pr.r, b)
+		if err != nil {
+			return 0, err
+		}
+		if string(b) != http2Preface {
+			return 0, errors.New("h2c: client did not send the HTTP/2 preface")
+		}
+		pr.seen = true
+	}
+	return pr.r.Read(p)
+}
+
+/*
+h2cConn is an upgraded connection. Reads first return the frames standing for
+the upgrade request.
+
+The server acknowledges the settings from the HTTP2-Settings header like any
+SETTINGS frame, but the client does not expect that: the first SETTINGS ACK
+the server writes is dropped.
+*/
+type h2cConn struct {
+	net.Conn
+	r io.Reader
+
+	// the server writes one frame at a time
+	ackDropped bool
+	head       []byte
+	payload    int
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *h2cConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *h2cConn) Write(p []byte) (int, error) {
+	if c.ackDropped {
+		return c.Conn.Write(p)
+	}
+
+	n := len(p)
+	out := make([]byte, 0, len(p))
+	for len(p) > 0 && !c.ackDropped {
+		if c.payload > 0 {
+			k := min(c.payload, len(p))
+			out = append(out, p[:k]...)
+			p = p[k:]
+			c.payload -= k
+			continue
+		}
+
+		// frame header: length (3 bytes), type, flags, stream (4 bytes)
+		k := min(9-len(c.head), len(p))
+		c.head = append(c.head, p[:k]...)
+		p = p[k:]
+		if len(c.head) < 9 {
+			break
+		}
+		if c.head[3] == frameSettings && c.head[4]&flagAck != 0 {
+			c.ackDropped = true
+		} else {
+			out = append(out, c.head...)
+			c.payload = int(c.head[0])<<16 | int(c.head[1])<<8 | int(c.head[2])
+		}
+		c.head = c.head[:0]
+	}
+	out = append(out, p...)
+
+	_, err := c.Conn.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (c *h2cConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+/*
+h2cListener hands out a single connection, and then blocks until it is closed
+or the listener is.
+*/
+type h2cListener struct {
+	conn *h2cConn
+	// only touched by Accept, which http.Server.Serve calls from one goroutine
+	accepted bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *h2cListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+
+	select {
+	case <-l.conn.closed:
+	case <-l.done:
+	}
+	return nil, net.ErrClosed
+}
+
+func (l *h2cListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *h2cListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,388 @@
+package endless
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHpackInt(t *testing.T) {
+	tests := []struct {
+		prefix uint
+		i      uint64
+		want   []byte
+	}{
+		{7, 0, []byte{0x00}},
+		{7, 126, []byte{0x7e}},
+		{7, 127, []byte{0x7f, 0x00}},
+		{7, 128, []byte{0x7f, 0x01}},
+		{7, 254, []byte{0x7f, 0x7f}},
+		{7, 255, []byte{0x7f, 0x80, 0x01}},
+		{7, 300, []byte{0x7f, 0xad, 0x01}},
+		{7, 16384, []byte{0x7f, 0x81, 0x7f}},
+		// RFC 7541, C.1
+		{5, 10, []byte{0x0a}},
+		{5, 1337, []byte{0x1f, 0x9a, 0x0a}},
+		{8, 42, []byte{0x2a}},
+	}
+
+	for _, tt := range tests {
+		got := hpackInt([]byte{0xff}, tt.prefix, tt.i)
+		if !bytes.Equal(got[1:], tt.want) || got[0] != 0xff {
+			t.Errorf("%d with %d bit prefix: % x, want % x", tt.i, tt.prefix, got[1:], tt.want)
+		}
+	}
+
+	for _, i := range []uint64{127, 1<<14 - 1, 1 << 14, 1<<21 + 5, 1<<32 + 1, 1<<63 + 1} {
+		b := hpackInt(nil, 7, i)
+		got, rest, err := decodeHpackInt(b, 7)
+		if err != nil || got != i || len(rest) != 0 {
+			t.Errorf("%d: decoded % x as %d, rest % x, %v", i, b, got, rest, err)
+		}
+	}
+}
+
+func TestH2CUpgradeFrames(t *testing.T) {
+	// SETTINGS_MAX_CONCURRENT_STREAMS 100, SETTINGS_INITIAL_WINDOW_SIZE 65535
+	settings := []byte{0, 3, 0, 0, 0, 100, 0, 4, 0, 0, 0xff, 0xff}
+	upgrade := "Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n"
+	long := strings.Repeat("a", 300)
+
+	tests := []struct {
+		name    string
+		request string
+		// the settings and header fields of the frames, without the pseudo
+		// header fields, or nil if the request is not upgraded
+		settings []byte
+		fields   []string
+	}{
+		{
+			name: "upgraded",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\n" + upgrade +
+				"HTTP2-Settings: AAMAAABkAAQAAP__\r\nAccept: text/plain\r\nX-Two: a\r\nX-Two: b\r\n" +
+				"Keep-Alive: 5\r\nTE: trailers\r\nProxy-Connection: keep-alive\r\n\r\n",
+			settings: settings,
+			fields:   []string{"accept: text/plain", "x-two: a", "x-two: b"},
+		},
+		{
+			name: "padded settings",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\n" + upgrade +
+				"HTTP2-Settings: AAMAAABk==\r\n\r\n",
+			settings: settings[:6],
+			fields:   []string{},
+		},
+		{
+			name: "no settings",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\n" + upgrade +
+				"HTTP2-Settings: \r\n\r\n",
+			settings: []byte{},
+			fields:   []string{},
+		},
+		{
+			name: "long value",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\n" + upgrade +
+				"HTTP2-Settings: \r\nX-Long: " + long + "\r\n\r\n",
+			settings: []byte{},
+			fields:   []string{"x-long: " + long},
+		},
+		{
+			name: "tokens in other order",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\nConnection: http2-settings\r\n" +
+				"Connection: keep-alive, upgrade\r\nUpgrade: websocket, H2C\r\nHTTP2-Settings: \r\n\r\n",
+			settings: []byte{},
+			fields:   []string{},
+		},
+		{
+			name:    "no upgrade",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\nHTTP2-Settings: \r\n\r\n",
+		},
+		{
+			name: "websocket",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+				"Upgrade: websocket\r\nHTTP2-Settings: \r\n\r\n",
+		},
+		{
+			name: "HTTP2-Settings not in Connection",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\n" +
+				"Upgrade: h2c\r\nHTTP2-Settings: \r\n\r\n",
+		},
+		{
+			name:    "no HTTP2-Settings",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\n" + upgrade + "\r\n",
+		},
+		{
+			name: "two HTTP2-Settings",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\n" + upgrade +
+				"HTTP2-Settings: \r\nHTTP2-Settings: \r\n\r\n",
+		},
+		{
+			name: "settings not base64url",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\n" + upgrade +
+				"HTTP2-Settings: AAMAAABkAAQAAP//\r\n\r\n",
+		},
+		{
+			name: "short setting",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\n" + upgrade +
+				"HTTP2-Settings: AAMAAAA\r\n\r\n",
+		},
+		{
+			name: "body",
+			request: "POST /path?q=1 HTTP/1.1\r\nHost: example.com\r\n" + upgrade +
+				"HTTP2-Settings: \r\nContent-Length: 3\r\n\r\nabc",
+		},
+		{
+			name: "chunked body",
+			request: "POST /path?q=1 HTTP/1.1\r\nHost: example.com\r\n" + upgrade +
+				"HTTP2-Settings: \r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name: "asterisk",
+			request: "OPTIONS * HTTP/1.1\r\nHost: example.com\r\n" + upgrade +
+				"HTTP2-Settings: \r\n\r\n",
+		},
+		{
+			name: "headers too large",
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: example.com\r\n" + upgrade +
+				"HTTP2-Settings: \r\nX-Long: " + strings.Repeat("a", http2MaxFrameSize) + "\r\n\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tt.request)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			frames, ok := h2cUpgradeFrames(r)
+			if tt.fields == nil {
+				if ok {
+					t.Errorf("upgraded to % x", frames)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("not upgraded")
+			}
+
+			rest, ok := bytes.CutPrefix(frames, []byte(http2Preface))
+			if !ok {
+				t.Fatalf("no preface in % x", frames)
+			}
+			typ, flags, stream, payload, rest, err := cutFrame(rest)
+			if err != nil || typ != frameSettings || flags != 0 || stream != 0 || !bytes.Equal(payload, tt.settings) {
+				t.Errorf("first frame %d, flags %d, stream %d, payload % x, %v, want settings % x",
+					typ, flags, stream, payload, err, tt.settings)
+			}
+			typ, flags, stream, payload, rest, err = cutFrame(rest)
+			if err != nil || typ != frameHeaders || flags != flagEndStream|flagEndHeader || stream != 1 {
+				t.Fatalf("second frame %d, flags %d, stream %d, %v, want headers", typ, flags, stream, err)
+			}
+			if len(rest) != 0 {
+				t.Errorf("% x after the frames", rest)
+			}
+
+			fields, err := decodeHpackLiterals(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{":method: GET", ":scheme: http", ":authority: example.com", ":path: /path?q=1"}
+			if !slices.Equal(fields[:min(4, len(fields))], want) {
+				t.Errorf("pseudo header fields %q, want %q", fields, want)
+			}
+			// the order of the others depends on the map
+			slices.Sort(fields[4:])
+			if !slices.Equal(fields[4:], tt.fields) {
+				t.Errorf("header fields %q, want %q", fields[4:], tt.fields)
+			}
+		})
+	}
+}
+
+func TestH2CConnWrite(t *testing.T) {
+	var frames []byte
+	frames = appendFrame(frames, frameSettings, 0, 0, []byte{0, 3, 0, 0, 0, 100})
+	frames = appendFrame(frames, 0x8, 0, 0, []byte{0, 0, 0xff, 0xff})
+	// looks like a SETTINGS ACK, but is the payload of the HEADERS frame
+	frames = appendFrame(frames, frameHeaders, flagEndHeader, 1, []byte{0, 0, 0, 4, 1, 0, 0, 0, 0})
+	ack := len(frames)
+	frames = appendFrame(frames, frameSettings, flagAck, 0, nil)
+	frames = appendFrame(frames, 0x0, flagEndStream, 1, []byte("hello"))
+	// the ACK of settings the client sent later
+	frames = appendFrame(frames, frameSettings, flagAck, 0, nil)
+	want := slices.Concat(frames[:ack], frames[ack+9:])
+
+	for _, size := range []int{1, 2, 4, 9, 10, 13, 16, len(frames)} {
+		t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+			var out bytes.Buffer
+			c := &h2cConn{Conn: &writeConn{w: &out}}
+			for p := frames; len(p) > 0; {
+				k := min(size, len(p))
+				n, err := c.Write(p[:k])
+				if n != k || err != nil {
+					t.Fatalf("wrote %d of %d bytes: %v", n, k, err)
+				}
+				p = p[k:]
+			}
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("wrote\n% x\nwant\n% x", out.Bytes(), want)
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		c := &h2cConn{Conn: &writeConn{w: io.Discard, err: io.ErrClosedPipe}}
+		n, err := c.Write(frames)
+		if n != 0 || err != io.ErrClosedPipe {
+			t.Errorf("wrote %d bytes, %v", n, err)
+		}
+	})
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	resetProcess(t)
+	srv := NewServer("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Proto, r.URL.Path)
+	}))
+	srv.H2C = true
+	startTestServer(t, srv)
+
+	c, err := net.Dial("tcp", srv.EndlessListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(c, "GET /hello HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABk\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "h2c" {
+		t.Fatalf("response %s, Upgrade %q", resp.Status, resp.Header.Get("Upgrade"))
+	}
+
+	c.Write(appendFrame([]byte(http2Preface), frameSettings, 0, 0, nil))
+
+	// the response to the request comes on stream 1, the only SETTINGS ACK
+	// is the one for the settings sent after the preface
+	var body []byte
+	acks := 0
+	for ended := false; !ended || acks == 0; {
+		typ, flags, stream, payload, err := readFrame(br)
+		if err != nil {
+			t.Fatalf("read frame: %v, body %q, %d acks", err, body, acks)
+		}
+		switch {
+		case typ == 0x7:
+			t.Fatalf("GOAWAY % x", payload)
+		case typ == frameSettings && flags&flagAck != 0:
+			acks++
+		case typ == 0x0 && stream == 1:
+			body = append(body, payload...)
+			ended = flags&flagEndStream != 0
+		}
+	}
+	if string(body) != "HTTP/2.0 /hello" {
+		t.Errorf("body %q", body)
+	}
+	if acks != 1 {
+		t.Errorf("%d SETTINGS ACKs", acks)
+	}
+}
+
+/*
+writeConn is a net.Conn that can only be written to.
+*/
+type writeConn struct {
+	net.Conn
+	w   io.Writer
+	err error
+}
+
+func (c *writeConn) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.w.Write(p)
+}
+
+func readFrame(r io.Reader) (typ, flags byte, stream uint32, payload []byte, err error) {
+	head := make([]byte, 9)
+	_, err = io.ReadFull(r, head)
+	if err != nil {
+		return
+	}
+	payload = make([]byte, int(head[0])<<16|int(head[1])<<8|int(head[2]))
+	_, err = io.ReadFull(r, payload)
+	return head[3], head[4], binary.BigEndian.Uint32(head[5:]) & 0x7fffffff, payload, err
+}
+
+func cutFrame(b []byte) (typ, flags byte, stream uint32, payload, rest []byte, err error) {
+	r := bytes.NewReader(b)
+	typ, flags, stream, payload, err = readFrame(r)
+	return typ, flags, stream, payload, b[len(b)-r.Len():], err
+}
+
+/*
+decodeHpackLiterals decodes a HPACK block written by hpackLiteral into
+"name: value" fields.
+*/
+func decodeHpackLiterals(b []byte) ([]string, error) {
+	var fields []string
+	for len(b) > 0 {
+		if b[0] != 0 {
+			return fields, fmt.Errorf("not a literal without indexing: % x", b)
+		}
+		var s [2]string
+		b = b[1:]
+		for i := range s {
+			n, rest, err := decodeHpackInt(b, 7)
+			if err != nil {
+				return fields, err
+			}
+			if b[0]&0x80 != 0 {
+				return fields, errors.New("huffman coded string")
+			}
+			if uint64(len(rest)) < n {
+				return fields, fmt.Errorf("string of %d bytes in % x", n, rest)
+			}
+			s[i], b = string(rest[:n]), rest[n:]
+		}
+		fields = append(fields, s[0]+": "+s[1])
+	}
+	return fields, nil
+}
+
+func decodeHpackInt(b []byte, prefix uint) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	max := uint64(1)<<prefix - 1
+	i := uint64(b[0]) & max
+	b = b[1:]
+	if i < max {
+		return i, b, nil
+	}
+	for shift := uint(0); len(b) > 0 && shift < 64; shift += 7 {
+		c := b[0]
+		b = b[1:]
+		i += uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return i, b, nil
+		}
+	}
+	return 0, nil, io.ErrUnexpectedEOF
+}
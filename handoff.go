@@ -0,0 +1,194 @@
+package endless
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// version of the handoff manifest. a child that does not know the version
+// falls back to ENDLESS_SOCKET_ORDER
+const manifestVersion = 1
+
+var errManifestVersion = errors.New("unsupported manifest version")
+
+/*
+handoffManifest describes the sockets a parent passes to its child. It is
+written as JSON to a pipe the child finds in ENDLESS_MANIFEST_FD.
+*/
+type handoffManifest struct {
+	Version int `json:"version"`
+	// generation of the child
+	Generation int             `json:"generation"`
+	ParentPid  int             `json:"parent_pid"`
+	Sockets    []handoffSocket `json:"sockets"`
+
+	// TLS session ticket keys, newest first, and when the newest was made
+	TicketKeys        [][]byte `json:"ticket_keys,omitempty"`
+	TicketKeysRotated int64    `json:"ticket_keys_rotated,omitempty"`
+}
+
+type handoffSocket struct {
+	Fd      int    `json:"fd"`
+	Name    string `json:"name"`
+	Network string `json:"network"`
+	// the address the socket is bound to
+	Address string `json:"address"`
+	// the socket came from systemd socket activation
+	Activated bool `json:"activated,omitempty"`
+	TLS       bool `json:"tls"`
+	// the certificate files the parent served
+	Certs []string `json:"certs,omitempty"`
+	// how the parent authenticated clients, and the CA files it used
+	ClientAuth string   `json:"client_auth,omitempty"`
+	ClientCAs  []string `json:"client_cas,omitempty"`
+}
+
+/*
+inheritedSocket is a socket passed by the parent.
+*/
+type inheritedSocket struct {
+	fd int
+	// empty if the parent did not tell (ENDLESS_SOCKET_ORDER)
+	network string
+	// the address the socket is bound to, empty if the parent did not tell
+	address string
+	// systemd owns the socket, see handoffSocket
+	activated bool
+	tls       bool
+	certs     []string
+	// client authentication of the parent, see handoffSocket
+	clientAuth string
+	clientCAs  []string
+	// why the socket must not be used
+	err error
+}
+
+/*
+writeManifest writes m to w and closes it.
+*/
+func writeManifest(w *os.File, m *handoffManifest) {
+	defer w.Close()
+
+	err := json.NewEncoder(w).Encode(m)
+	if err != nil {
+		logEvent(slog.LevelError, "manifest_error", "Failed to write handoff manifest", "error", err)
+	}
+}
+
+/*
+readManifest reads the manifest the parent passed in ENDLESS_MANIFEST_FD. It
+returns nil if there is none, and errManifestVersion if the parent wrote a
+version we don't know.
+*/
+func readManifest() (m *handoffManifest, err error) {
+	v := os.Getenv("ENDLESS_MANIFEST_FD")
+	if v == "" {
+		return
+	}
+	os.Unsetenv("ENDLESS_MANIFEST_FD")
+
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < 3 {
+		return nil, fmt.Errorf("invalid ENDLESS_MANIFEST_FD %q", v)
+	}
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "endless-manifest")
+	defer f.Close()
+
+	m = &handoffManifest{}
+	err = json.NewDecoder(f).Decode(m)
+	if err != nil {
+		return nil, err
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("%w %d", errManifestVersion, m.Version)
+	}
+	return
+}
+
+/*
+check makes sure that fd is what the parent says it is: a socket of the right
+type, bound to the address the parent listened on.
+*/
+func (s *handoffSocket) check(m *handoffManifest) error {
+	if ppid := syscall.Getppid(); m.ParentPid != ppid {
+		return fmt.Errorf("manifest is from pid %d, our parent is %d", m.ParentPid, ppid)
+	}
+	if m.Generation != generation {
+		return fmt.Errorf("manifest is for generation %d, we are %d", m.Generation, generation)
+	}
+
+	typ, err := syscall.GetsockoptInt(s.Fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return fmt.Errorf("fd %d is not a socket: %v", s.Fd, err)
+	}
+	if want := socketType(s.Network); typ != want {
+		return fmt.Errorf("fd %d has socket type %d, %s wants %d", s.Fd, typ, s.Network, want)
+	}
+
+	addr, err := socketAddress(s.Fd)
+	if err != nil {
+		return err
+	}
+	if addr != s.Address {
+		return fmt.Errorf("fd %d is bound to %s, not %s", s.Fd, addr, s.Address)
+	}
+	return nil
+}
+
+/*
+socketAddress returns the address fd is bound to.
+*/
+func socketAddress(fd int) (string, error) {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return "", fmt.Errorf("getsockname of fd %d: %v", fd, err)
+	}
+
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port)), nil
+	case *syscall.SockaddrInet6:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port)), nil
+	case *syscall.SockaddrUnix:
+		return sa.Name, nil
+	}
+	return "", fmt.Errorf("fd %d has an unknown address family", fd)
+}
+
+/*
+socketNetAddr returns address, as reported by socketAddress, as a net.Addr of
+network, or nil if it can't be parsed.
+*/
+func socketNetAddr(network, address string) net.Addr {
+	switch {
+	case strings.HasPrefix(network, "unix"):
+		return &net.UnixAddr{Name: address, Net: network}
+	case strings.HasPrefix(network, "udp"):
+		if addr, err := net.ResolveUDPAddr(network, address); err == nil {
+			return addr
+		}
+		return nil
+	}
+	if addr, err := net.ResolveTCPAddr(network, address); err == nil {
+		return addr
+	}
+	return nil
+}
+
+func socketType(network string) int {
+	switch {
+	case strings.HasPrefix(network, "udp"), network == "unixgram":
+		return syscall.SOCK_DGRAM
+	case network == "unixpacket":
+		return syscall.SOCK_SEQPACKET
+	}
+	return syscall.SOCK_STREAM
+}
@@ -0,0 +1,307 @@
+package endless
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestHandoffSocketCheck(t *testing.T) {
+	resetProcess(t)
+	generation = 2
+
+	tcpFd, tcpAddr := inheritSocket(t, "tcp")
+	unixFd, unixAddr := inheritSocket(t, "unix")
+	udpFd, udpAddr := inheritPacketSocket(t)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeFd := int(r.Fd())
+	defer func() {
+		for _, fd := range []int{tcpFd, unixFd, udpFd} {
+			syscall.Close(fd)
+		}
+		r.Close()
+		w.Close()
+	}()
+
+	manifest := handoffManifest{Version: manifestVersion, Generation: 2, ParentPid: syscall.Getppid()}
+	tests := []struct {
+		name     string
+		socket   handoffSocket
+		manifest func(m *handoffManifest)
+		wantErr  string
+	}{
+		{name: "tcp", socket: handoffSocket{Fd: tcpFd, Network: "tcp", Address: tcpAddr}},
+		{name: "unix", socket: handoffSocket{Fd: unixFd, Network: "unix", Address: unixAddr}},
+		{name: "udp", socket: handoffSocket{Fd: udpFd, Network: "udp", Address: udpAddr}},
+		{
+			name:     "other parent",
+			socket:   handoffSocket{Fd: tcpFd, Network: "tcp", Address: tcpAddr},
+			manifest: func(m *handoffManifest) { m.ParentPid = 1 },
+			wantErr:  fmt.Sprintf("manifest is from pid 1, our parent is %d", syscall.Getppid()),
+		},
+		{
+			name:     "other generation",
+			socket:   handoffSocket{Fd: tcpFd, Network: "tcp", Address: tcpAddr},
+			manifest: func(m *handoffManifest) { m.Generation = 3 },
+			wantErr:  "manifest is for generation 3, we are 2",
+		},
+		{
+			name:    "no socket",
+			socket:  handoffSocket{Fd: pipeFd, Network: "tcp", Address: tcpAddr},
+			wantErr: fmt.Sprintf("fd %d is not a socket", pipeFd),
+		},
+		{
+			name:    "stream socket for udp",
+			socket:  handoffSocket{Fd: tcpFd, Network: "udp", Address: tcpAddr},
+			wantErr: fmt.Sprintf("fd %d has socket type %d, udp wants %d", tcpFd, syscall.SOCK_STREAM, syscall.SOCK_DGRAM),
+		},
+		{
+			name:    "other address",
+			socket:  handoffSocket{Fd: tcpFd, Network: "tcp", Address: "127.0.0.1:1"},
+			wantErr: fmt.Sprintf("fd %d is bound to %s, not 127.0.0.1:1", tcpFd, tcpAddr),
+		},
+		{
+			name:    "other path",
+			socket:  handoffSocket{Fd: unixFd, Network: "unix", Address: unixAddr + ".old"},
+			wantErr: fmt.Sprintf("fd %d is bound to %s, not %s.old", unixFd, unixAddr, unixAddr),
+		},
+	}
+
+	for _, tt := range tests {
+		m := manifest
+		if tt.manifest != nil {
+			tt.manifest(&m)
+		}
+		err := tt.socket.check(&m)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		} else if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error %v, want %s", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+/*
+inheritPacketSocket is inheritSocket for a UDP socket.
+*/
+func inheritPacketSocket(t *testing.T) (int, string) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, err := c.(filer).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := socketAddress(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd, addr
+}
+
+/*
+passManifest makes data readable from the pipe in ENDLESS_MANIFEST_FD.
+*/
+func passManifest(t *testing.T, data string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		w.WriteString(data)
+		w.Close()
+	}()
+
+	// readManifest closes it
+	fd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ENDLESS_MANIFEST_FD", strconv.Itoa(fd))
+}
+
+func TestReadManifest(t *testing.T) {
+	valid, err := json.Marshal(&handoffManifest{
+		Version:    manifestVersion,
+		Generation: 3,
+		ParentPid:  42,
+		Sockets:    []handoffSocket{{Fd: 3, Name: "api", Network: "tcp", Address: "127.0.0.1:8080"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		manifest string
+		// ENDLESS_MANIFEST_FD instead of a pipe with manifest
+		env         string
+		wantSockets int
+		wantErr     string
+		wantVersion bool
+	}{
+		{name: "valid", manifest: string(valid), wantSockets: 1},
+		{name: "none"},
+		{name: "broken", manifest: `{"version":1,"sockets":[{"fd":`, wantErr: "unexpected EOF"},
+		{name: "empty", manifest: "", wantErr: "EOF"},
+		{name: "unknown version", manifest: `{"version":99}`, wantErr: "unsupported manifest version 99", wantVersion: true},
+		{name: "invalid fd", env: "stdin", wantErr: `invalid ENDLESS_MANIFEST_FD "stdin"`},
+		{name: "stdin", env: "0", wantErr: `invalid ENDLESS_MANIFEST_FD "0"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			switch {
+			case tt.env != "":
+				t.Setenv("ENDLESS_MANIFEST_FD", tt.env)
+			case tt.name == "none":
+				t.Setenv("ENDLESS_MANIFEST_FD", "")
+			default:
+				passManifest(t, tt.manifest)
+			}
+
+			m, err := readManifest()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.name == "none" {
+					if m != nil {
+						t.Errorf("manifest %+v without ENDLESS_MANIFEST_FD", m)
+					}
+					return
+				}
+				if m == nil || len(m.Sockets) != tt.wantSockets || m.Generation != 3 || m.ParentPid != 42 {
+					t.Errorf("manifest %+v", m)
+				}
+			} else {
+				if err == nil || err.Error() != tt.wantErr || m != nil {
+					t.Errorf("manifest %+v, error %v, want error %s", m, err, tt.wantErr)
+				}
+				if errors.Is(err, errManifestVersion) != tt.wantVersion {
+					t.Errorf("error %v is errManifestVersion: %v, want %v", err, !tt.wantVersion, tt.wantVersion)
+				}
+			}
+			if v := os.Getenv("ENDLESS_MANIFEST_FD"); v != "" {
+				t.Errorf("ENDLESS_MANIFEST_FD left set to %s", v)
+			}
+		})
+	}
+}
+
+func TestLoadInheritedSockets(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		// the inherited sockets and the error each of them has
+		want map[string]string
+	}{
+		{
+			name:     "broken manifest",
+			manifest: `{"version":1,`,
+			want: map[string]string{
+				"api":   "handoff manifest: unexpected EOF",
+				"admin": "handoff manifest: unexpected EOF",
+			},
+		},
+		{
+			name:     "unknown version",
+			manifest: `{"version":99}`,
+			want:     map[string]string{"api": "", "admin": ""},
+		},
+		{
+			// fd 3 and 4 are not what the manifest says
+			name: "mismatch",
+			manifest: fmt.Sprintf(`{"version":1,"generation":1,"parent_pid":%d,"sockets":[`+
+				`{"fd":3,"name":"api","network":"tcp","address":"127.0.0.1:1"}]}`, syscall.Getppid()),
+			want: map[string]string{"api": "fd 3 "},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetProcess(t)
+			generation = 1
+			socketOrder = "api,admin"
+			passManifest(t, tt.manifest)
+
+			runningServerReg.Lock()
+			loadInheritedSockets("api")
+			got := inheritedSockets
+			// not ours to close
+			inheritedSockets = map[string]*inheritedSocket{}
+			runningServerReg.Unlock()
+
+			if len(got) != len(tt.want) {
+				t.Errorf("inherited sockets %v, want %v", got, tt.want)
+			}
+			for name, wantErr := range tt.want {
+				is, ok := got[name]
+				switch {
+				case !ok:
+					t.Errorf("no inherited socket %s", name)
+				case wantErr == "" && is.err != nil:
+					t.Errorf("socket %s: %v", name, is.err)
+				case wantErr != "" && (is.err == nil || !strings.HasPrefix(is.err.Error(), wantErr)):
+					t.Errorf("socket %s: error %v, want %s", name, is.err, wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestInheritActivatedSocket(t *testing.T) {
+	for _, activated := range []bool{true, false} {
+		t.Run(fmt.Sprintf("activated %v", activated), func(t *testing.T) {
+			resetProcess(t)
+			generation = 1
+			fd, addr := inheritSocket(t, "unix")
+			m, err := json.Marshal(&handoffManifest{
+				Version:    manifestVersion,
+				Generation: 1,
+				ParentPid:  syscall.Getppid(),
+				Sockets:    []handoffSocket{{Fd: fd, Name: "api", Network: "unix", Address: addr, Activated: activated}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			passManifest(t, string(m))
+
+			runningServerReg.Lock()
+			loadInheritedSockets("api")
+			runningServerReg.Unlock()
+
+			srv := newServer("unix", "api", addr, nil)
+			f, err := srv.claimInheritedSocket(srv.Addr)
+			if err != nil || f == nil {
+				t.Fatalf("claimed %v, %v", f, err)
+			}
+			f.Close()
+			// the socket file is removed on shutdown unless systemd owns it
+			if srv.socketActivated != activated {
+				t.Errorf("socketActivated %v, want %v", srv.socketActivated, activated)
+			}
+		})
+	}
+}
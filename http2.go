@@ -0,0 +1,82 @@
+package endless
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	// DisableHTTP2 keeps TLS servers from offering HTTP/2, they only speak
+	// HTTP/1.1 then. A single server can opt out the net/http way, by setting
+	// its TLSNextProto to an empty map.
+	DisableHTTP2 bool
+)
+
+/*
+http2Enabled tells whether srv should offer HTTP/2 over TLS.
+*/
+func (srv *endlessServer) http2Enabled() bool {
+	if DisableHTTP2 {
+		return false
+	}
+	if srv.TLSNextProto != nil && len(srv.TLSNextProto) == 0 {
+		return false
+	}
+	if srv.Protocols != nil && !srv.Protocols.HTTP2() {
+		return false
+	}
+	// net/http would not serve it
+	return !strings.Contains(os.Getenv("GODEBUG"), "http2server=0")
+}
+
+/*
+ListenAndServeH2C is like ListenAndServe, but also accepts cleartext HTTP/2
+(h2c) connections, see endlessServer.H2C.
+*/
+func ListenAndServeH2C(addr string, handler http.Handler) error {
+	server := NewServer(addr, handler)
+	server.H2C = true
+	return server.ListenAndServe()
+}
+
+/*
+enableH2C makes srv accept h2c next to HTTP/1.1, from clients with prior
+knowledge and from those that send "Upgrade: h2c" (see h2cUpgradeHandler).
+*/
+func (srv *endlessServer) enableH2C() {
+	if srv.Protocols == nil {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+	}
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	if _, ok := srv.Handler.(*h2cUpgradeHandler); !ok {
+		srv.Handler = &h2cUpgradeHandler{srv: srv, next: srv.Handler}
+	}
+}
+
+/*
+goAway sends GOAWAY to the HTTP/2 clients of srv, so they stop opening new
+streams on their connections, and closes idle connections. Streams already
+running are finished and Serve waits for them.
+
+This is done by http.Server.Shutdown (with a context that is done already, so it
+does not wait itself), which can't be undone. Suspended servers don't get it.
+*/
+func (srv *endlessServer) goAway() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	srv.Server.Shutdown(ctx)
+
+	// and the connections upgraded to h2c
+	srv.connsLock.Lock()
+	servers := make([]*http.Server, 0, len(srv.h2cServers))
+	for h2srv := range srv.h2cServers {
+		servers = append(servers, h2srv)
+	}
+	srv.connsLock.Unlock()
+	for _, h2srv := range servers {
+		h2srv.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,58 @@
+package endless
+
+import (
+	"log/slog"
+)
+
+/*
+Listen announces on the local network address addr like net.Listen and returns
+a listener that takes part in restarts like the listeners of the HTTP servers
+do: it is handed over to the child on SIGHUP and closed once the child is
+ready. Use it for servers other than net/http that serve on a net.Listener.
+
+network must be "tcp", "tcp4", "tcp6" or "unix".
+
+Connections returned by Accept are tracked until they are closed. After the
+listener got closed call Wait to wait for them to finish.
+*/
+func Listen(network, addr string) (el *endlessListener, err error) {
+	srv := newServer(network, "", addr, nil)
+	return srv.listen()
+}
+
+/*
+listen gets the listener for srv and marks it as running without serving on it.
+*/
+func (srv *endlessServer) listen() (el *endlessListener, err error) {
+	go srv.handleSignals()
+
+	l, err := srv.getListener(srv.Addr)
+	if err != nil {
+		srv.logEvent(slog.LevelError, "listen_error", err.Error())
+		return
+	}
+
+	el = newEndlessListener(l, srv)
+	srv.EndlessListener = el
+
+	srv.listening()
+
+	srv.BeforeBegin(srv.Addr)
+	srv.setState(STATE_RUNNING)
+
+	return
+}
+
+/*
+Wait blocks until all connections accepted on el got closed. Call it once the
+listener is closed (the loop calling Accept returns) to let outstanding
+connections finish before exiting.
+*/
+func (el *endlessListener) Wait() {
+	defer el.server.logEvent(slog.LevelInfo, "drained", "Drained.")
+	el.server.logEvent(slog.LevelInfo, "drain", "Waiting for connections to finish...")
+	el.server.wg.Wait()
+	el.server.metrics.drained()
+	pendingReplies.Wait()
+	el.server.setState(STATE_TERMINATE)
+}
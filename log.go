@@ -0,0 +1,74 @@
+package endless
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"syscall"
+)
+
+var logger *slog.Logger
+
+/*
+SetLogger makes endless log to l instead of the functions set with SetLoggers.
+Every lifecycle event is logged with the attributes event, pid, ppid and
+generation, events of a server also carry its addr and state.
+*/
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+/*
+logEvent logs msg with the key-value pairs in args. Without a slog.Logger the
+line is printed with logPrintf as "<pid> <msg> key=value...".
+*/
+func logEvent(level slog.Level, event string, msg string, args ...interface{}) {
+	if logger == nil {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%d %s", syscall.Getpid(), msg)
+		for i := 0; i+1 < len(args); i += 2 {
+			fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		}
+		logPrintf("%s", b.String())
+		return
+	}
+
+	attrs := []interface{}{
+		"event", event,
+		"pid", syscall.Getpid(),
+		"ppid", syscall.Getppid(),
+		"generation", generation,
+	}
+	logger.Log(context.Background(), level, msg, append(attrs, args...)...)
+}
+
+/*
+logEvent logs an event of srv.
+*/
+func (srv *endlessServer) logEvent(level slog.Level, event string, msg string, args ...interface{}) {
+	if srv.name != srv.Addr {
+		args = append([]interface{}{"name", srv.name}, args...)
+	}
+	args = append([]interface{}{"addr", srv.Addr}, args...)
+	if logger != nil {
+		args = append(args, "state", stateName(srv.getState()))
+	}
+	logEvent(level, event, msg, args...)
+}
+
+func stateName(st uint8) string {
+	switch st {
+	case STATE_INIT:
+		return "init"
+	case STATE_RUNNING:
+		return "running"
+	case STATE_SHUTTING_DOWN:
+		return "shutting_down"
+	case STATE_TERMINATE:
+		return "terminate"
+	case STATE_SUSPENDED:
+		return "suspended"
+	}
+	return fmt.Sprintf("unknown(%d)", st)
+}
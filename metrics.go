@@ -0,0 +1,129 @@
+package endless
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type serverMetrics struct {
+	accepted atomic.Int64
+	closed   atomic.Int64
+	hammered atomic.Int64
+
+	shutdownStart atomic.Int64 // unix nanoseconds
+	drainDuration atomic.Int64 // nanoseconds
+}
+
+var (
+	restartAttempts  atomic.Int64
+	restartSuccesses atomic.Int64
+	restartFailures  atomic.Int64
+)
+
+/*
+startDrain records the time srv started shutting down.
+*/
+func (m *serverMetrics) startDrain() {
+	m.shutdownStart.Store(time.Now().UnixNano())
+}
+
+/*
+drained records how long it took from shutting down until the last connection
+got closed.
+*/
+func (m *serverMetrics) drained() {
+	if start := m.shutdownStart.Load(); start != 0 {
+		m.drainDuration.Store(time.Now().UnixNano() - start)
+	}
+}
+
+/*
+MetricsHandler returns a http.Handler that serves the metrics of this process in
+the Prometheus text format:
+
+	endless_generation                               number of restarts that led to this process
+	endless_restart_attempts_total                   forks started
+	endless_restart_successes_total                  children that took over
+	endless_restart_failures_total                   children that failed to take over
+	endless_connections_accepted_total{name,addr}    connections accepted
+	endless_connections_closed_total{name,addr}      connections closed
+	endless_connections_active{name,addr}            connections currently open
+	endless_connections_hammered_total{name,addr}    connections closed forcefully
+	endless_drain_duration_seconds{name,addr}        time from shutdown until all connections were closed
+
+name is the name of the server (see NewNamedServer) and addr the address it
+listens on.
+*/
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+}
+
+func writeMetrics(w io.Writer) {
+	writeMetric(w, "endless_generation", "gauge",
+		"Number of restarts that led to this process.")
+	fmt.Fprintf(w, "endless_generation %d\n", generation)
+
+	writeMetric(w, "endless_restart_attempts_total", "counter",
+		"Forks started.")
+	fmt.Fprintf(w, "endless_restart_attempts_total %d\n", restartAttempts.Load())
+
+	writeMetric(w, "endless_restart_successes_total", "counter",
+		"Forked children that took over.")
+	fmt.Fprintf(w, "endless_restart_successes_total %d\n", restartSuccesses.Load())
+
+	writeMetric(w, "endless_restart_failures_total", "counter",
+		"Forked children that failed to take over.")
+	fmt.Fprintf(w, "endless_restart_failures_total %d\n", restartFailures.Load())
+
+	runningServerReg.RLock()
+	servers := make([]*endlessServer, 0, len(runningServersOrder))
+	for _, name := range runningServersOrder {
+		if srv, ok := runningServers[name]; ok {
+			servers = append(servers, srv)
+		}
+	}
+	runningServerReg.RUnlock()
+
+	perServer := []struct {
+		name, typ, help string
+		value           func(srv *endlessServer) string
+	}{
+		{"endless_connections_accepted_total", "counter", "Connections accepted.",
+			func(srv *endlessServer) string { return fmt.Sprint(srv.metrics.accepted.Load()) }},
+		{"endless_connections_closed_total", "counter", "Connections closed.",
+			func(srv *endlessServer) string { return fmt.Sprint(srv.metrics.closed.Load()) }},
+		{"endless_connections_active", "gauge", "Connections currently open.",
+			func(srv *endlessServer) string { return fmt.Sprint(srv.activeConns()) }},
+		{"endless_connections_hammered_total", "counter", "Connections closed forcefully.",
+			func(srv *endlessServer) string { return fmt.Sprint(srv.metrics.hammered.Load()) }},
+		{"endless_drain_duration_seconds", "gauge", "Time from shutdown until all connections were closed.",
+			func(srv *endlessServer) string {
+				return fmt.Sprint(time.Duration(srv.metrics.drainDuration.Load()).Seconds())
+			}},
+	}
+
+	for _, m := range perServer {
+		writeMetric(w, m.name, m.typ, m.help)
+		for _, srv := range servers {
+			fmt.Fprintf(w, "%s{name=\"%s\",addr=\"%s\"} %s\n",
+				m.name, escapeLabel(srv.name), escapeLabel(srv.Addr), m.value(srv))
+		}
+	}
+}
+
+func writeMetric(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,41 @@
+package endless
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetricsLabels(t *testing.T) {
+	tests := []struct {
+		name, addr string
+		labels     string
+	}{
+		{"plain", "localhost:8080", `name="plain",addr="localhost:8080"`},
+		{`quo"te`, "[::1]:8080", `name="quo\"te",addr="[::1]:8080"`},
+		{`back\slash`, "localhost:8081", `name="back\\slash",addr="localhost:8081"`},
+		{"new\nline", "/run/app.sock", `name="new\nline",addr="/run/app.sock"`},
+	}
+
+	resetProcess(t)
+	for _, tt := range tests {
+		NewNamedServer(tt.name, tt.addr, nil)
+	}
+
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	out := buf.String()
+
+	for _, tt := range tests {
+		want := "endless_connections_accepted_total{" + tt.labels + "} 0\n"
+		if !strings.Contains(out, want) {
+			t.Errorf("%q: no %q in\n%s", tt.name, want, out)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if line == "" {
+			t.Errorf("empty line, a label value was not escaped:\n%s", out)
+			break
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package endless
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ListenPacket announces on the local network address addr like net.ListenPacket
+and returns a PacketConn that takes part in restarts: it is handed over to the
+child on SIGHUP and once the child is ready ReadFrom returns net.ErrClosed.
+Replies to packets already read can still be written, Close the PacketConn when
+done.
+
+network must be "udp", "udp4" or "udp6".
+*/
+func ListenPacket(network, addr string) (pc *endlessPacketConn, err error) {
+	srv := newServer(network, "", addr, nil)
+
+	go srv.handleSignals()
+
+	var c net.PacketConn
+	f, err := srv.claimInheritedSocket(addr)
+	if err != nil {
+		srv.logEvent(slog.LevelError, "listen_error", err.Error())
+		return
+	}
+	if f != nil {
+		c, err = net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			err = fmt.Errorf("net.FilePacketConn error: %v", err)
+		}
+	} else {
+		c, err = activatedPacketConn(network, srv.name, addr)
+		if c == nil && err == nil {
+			c, err = net.ListenPacket(network, addr)
+			if err != nil {
+				err = fmt.Errorf("net.ListenPacket error: %v", err)
+			}
+		}
+	}
+	if err != nil {
+		srv.logEvent(slog.LevelError, "listen_error", err.Error())
+		return
+	}
+
+	pc = newEndlessPacketConn(c, srv)
+	srv.packetConn = pc
+
+	srv.listening()
+
+	srv.BeforeBegin(srv.Addr)
+	srv.setState(STATE_RUNNING)
+
+	return
+}
+
+type endlessPacketConn struct {
+	net.PacketConn
+	server  *endlessServer
+	stopped bool
+
+	// closed while reading is not paused
+	unpaused chan struct{}
+	lock     sync.Mutex
+}
+
+func newEndlessPacketConn(c net.PacketConn, srv *endlessServer) (pc *endlessPacketConn) {
+	pc = &endlessPacketConn{
+		PacketConn: c,
+		server:     srv,
+		unpaused:   make(chan struct{}),
+	}
+	close(pc.unpaused)
+
+	return
+}
+
+func (pc *endlessPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		unpaused, stopped := pc.readState()
+		if stopped {
+			err = net.ErrClosed
+			return
+		}
+		<-unpaused
+
+		n, addr, err = pc.PacketConn.ReadFrom(b)
+		if err == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		if _, stopped = pc.readState(); !stopped && !pc.paused() {
+			return
+		}
+		// got kicked out of ReadFrom by pause() or stop()
+	}
+}
+
+func (pc *endlessPacketConn) Close() error {
+	pc.server.setState(STATE_TERMINATE)
+	return pc.PacketConn.Close()
+}
+
+func (pc *endlessPacketConn) File() *os.File {
+	// returns a dup(2) - FD_CLOEXEC flag *not* set
+	fl, _ := pc.PacketConn.(filer).File()
+	return fl
+}
+
+/*
+stop makes ReadFrom return net.ErrClosed. The socket stays open so that replies
+can be written.
+*/
+func (pc *endlessPacketConn) stop() {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	pc.stopped = true
+	pc.PacketConn.SetReadDeadline(time.Now())
+	select {
+	case <-pc.unpaused:
+	default:
+		close(pc.unpaused)
+	}
+}
+
+/*
+pause makes ReadFrom block until resume is called. Packets queue up in the
+socket buffer (or get read by another process sharing the socket).
+*/
+func (pc *endlessPacketConn) pause() {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	select {
+	case <-pc.unpaused:
+		pc.unpaused = make(chan struct{})
+	default:
+		return
+	}
+
+	// kick a pending ReadFrom out of the read syscall
+	pc.PacketConn.SetReadDeadline(time.Now())
+}
+
+func (pc *endlessPacketConn) resume() {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	select {
+	case <-pc.unpaused:
+		return
+	default:
+	}
+
+	pc.PacketConn.SetReadDeadline(time.Time{})
+	close(pc.unpaused)
+}
+
+func (pc *endlessPacketConn) paused() bool {
+	unpaused, _ := pc.readState()
+	select {
+	case <-unpaused:
+		return false
+	default:
+		return true
+	}
+}
+
+func (pc *endlessPacketConn) readState() (unpaused <-chan struct{}, stopped bool) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	return pc.unpaused, pc.stopped
+}
@@ -0,0 +1,100 @@
+package endless
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	// PidFile is written with the pid of the process once all servers are
+	// listening. After a restart the child replaces it with its own pid once
+	// it got ready, so the file always names the process that is serving.
+	// It is removed when the last generation shuts down. empty disables it
+	PidFile string
+)
+
+/*
+becameReady is called once all servers of this process are listening and (if
+we are a child) the parent was told. sdState is sent to systemd.
+*/
+func becameReady(sdState string) {
+	processReadyOnce.Do(func() {
+		close(processReady)
+		writePidFile()
+		sdNotify(sdState)
+	})
+}
+
+/*
+writePidFile writes our pid to PidFile. The file is replaced by a rename so that
+readers never see a partly written pid.
+*/
+func writePidFile() {
+	if PidFile == "" {
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(PidFile), "."+filepath.Base(PidFile))
+	if err != nil {
+		logEvent(slog.LevelError, "pidfile_error", "Failed to write pid file", "path", PidFile, "error", err)
+		return
+	}
+	_, err = tmp.WriteString(strconv.Itoa(syscall.Getpid()) + "\n")
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), PidFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logEvent(slog.LevelError, "pidfile_error", "Failed to write pid file", "path", PidFile, "error", err)
+		return
+	}
+	logEvent(slog.LevelInfo, "pidfile", "Wrote pid file", "path", PidFile)
+}
+
+/*
+removePidFile removes PidFile if it still holds our pid. A child that took
+over already put its own pid there.
+*/
+func removePidFile() {
+	removePidFileOf(syscall.Getpid())
+}
+
+/*
+removePidFileOf removes PidFile if it holds one of pids.
+*/
+func removePidFileOf(pids ...int) {
+	if PidFile == "" {
+		return
+	}
+
+	pid, err := ReadPidFile(PidFile)
+	if err != nil || !slices.Contains(pids, pid) {
+		return
+	}
+	err = os.Remove(PidFile)
+	if err != nil && !os.IsNotExist(err) {
+		logEvent(slog.LevelError, "pidfile_error", "Failed to remove pid file", "path", PidFile, "error", err)
+	}
+}
+
+/*
+ReadPidFile returns the pid written to path.
+*/
+func ReadPidFile(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
@@ -0,0 +1,173 @@
+package endless
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// RedirectStatus is the status code ListenAndServeTLSWithRedirect
+	// redirects with. Use http.StatusPermanentRedirect to keep clients from
+	// turning POST requests into GET.
+	RedirectStatus = http.StatusMovedPermanently
+
+	// RedirectHost is the host name (without port) that
+	// ListenAndServeTLSWithRedirect redirects to. Empty keeps the host the
+	// client asked for.
+	RedirectHost string
+)
+
+/*
+ListenAndServeTLSWithRedirect is like ListenAndServeTLS on httpsAddr, and
+serves plain HTTP on httpAddr that redirects every request to the same URL with
+https, on the port of httpsAddr. Both servers are restarted together. It
+returns once both of them stopped; if one of them fails the other is shut down.
+*/
+func ListenAndServeTLSWithRedirect(httpAddr, httpsAddr, certFile, keyFile string, handler http.Handler) error {
+	if httpsAddr == "" {
+		httpsAddr = ":https"
+	}
+	port, err := redirectPort(httpsAddr)
+	if err != nil {
+		return err
+	}
+
+	httpsServer := NewServer(httpsAddr, handler)
+	httpServer := NewServer(httpAddr, redirectHandler(port))
+
+	httpsErr := serveWith(httpsServer, func() error {
+		return httpsServer.ListenAndServeTLS(certFile, keyFile)
+	})
+	if err = <-httpsErr.started; err != nil {
+		return err
+	}
+	// start the redirects once there is something to redirect to
+	httpErr := serveWith(httpServer, httpServer.ListenAndServe)
+	if err = <-httpErr.started; err != nil {
+		httpsServer.Close()
+		<-httpsErr.done
+		return err
+	}
+
+	// both are serving, and neither goes on alone: if one of them failed
+	// the other one is shut down, and if one of them was shut down the
+	// other one is on its way as well. either way its connections get up
+	// to DefaultHammerTime to finish.
+	var peer *endlessServer
+	var peerErr chan error
+	select {
+	case err = <-httpsErr.done:
+		peer, peerErr = httpServer, httpErr.done
+	case err = <-httpErr.done:
+		peer, peerErr = httpsServer, httpsErr.done
+	}
+	ctx := context.Background()
+	if DefaultHammerTime >= 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultHammerTime)
+		defer cancel()
+	}
+	peer.Shutdown(ctx)
+	<-peerErr
+	return err
+}
+
+/*
+serving is a server run by serveWith.
+*/
+type serving struct {
+	// nil once the server is serving, or the error it failed to start with
+	started chan error
+	// what serve returned
+	done chan error
+}
+
+/*
+serveWith runs serve, which starts srv, in a goroutine.
+*/
+func serveWith(srv *endlessServer, serve func() error) *serving {
+	s := &serving{
+		started: make(chan error, 1),
+		done:    make(chan error, 1),
+	}
+	var once sync.Once
+	srv.onServe = func() {
+		once.Do(func() { s.started <- nil })
+	}
+	go func() {
+		err := serve()
+		once.Do(func() {
+			if err == nil {
+				err = fmt.Errorf("%s stopped before serving", srv.Addr)
+			}
+			s.started <- err
+		})
+		s.done <- err
+	}()
+	return s
+}
+
+/*
+redirectPort returns the port to redirect to for httpsAddr, empty for the
+default port 443.
+*/
+func redirectPort(httpsAddr string) (string, error) {
+	_, port, err := net.SplitHostPort(httpsAddr)
+	if err != nil {
+		return "", err
+	}
+	n, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return "", err
+	}
+	switch n {
+	case 0:
+		return "", fmt.Errorf("can't redirect to %s, it has no fixed port", httpsAddr)
+	case 443:
+		return "", nil
+	}
+	return strconv.Itoa(n), nil
+}
+
+/*
+redirectHandler redirects requests to https on port (the default one if
+empty), keeping the path and query.
+*/
+func redirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := RedirectHost
+		if host == "" {
+			host = r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			} else {
+				host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+			}
+		}
+		if host == "" {
+			http.Error(w, "missing Host header", http.StatusBadRequest)
+			return
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			// IPv6
+			host = "[" + host + "]"
+		}
+
+		u := url.URL{
+			Scheme:   "https",
+			Host:     host,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
+			RawQuery: r.URL.RawQuery,
+		}
+		http.Redirect(w, r, u.String(), RedirectStatus)
+	})
+}
@@ -0,0 +1,71 @@
+package endless
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectPort(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{":443", "", false},
+		{":https", "", false},
+		{"example.com:443", "", false},
+		{":8443", "8443", false},
+		{"[::1]:8443", "8443", false},
+		{"[::1]:https", "", false},
+		{":0", "", true},
+		{"example.com", "", true},
+		{":nosuchservice", "", true},
+	}
+	for _, tt := range tests {
+		got, err := redirectPort(tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("redirectPort(%q) error = %v, want error %v", tt.addr, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("redirectPort(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		port, redirectHost string
+		host, target       string
+		wantStatus         int
+		wantLocation       string
+	}{
+		{"", "", "example.com", "/a/b?c=d", http.StatusMovedPermanently, "https://example.com/a/b?c=d"},
+		{"", "", "example.com:80", "/", http.StatusMovedPermanently, "https://example.com/"},
+		{"8443", "", "example.com:8080", "/x", http.StatusMovedPermanently, "https://example.com:8443/x"},
+		{"", "", "[::1]:80", "/x", http.StatusMovedPermanently, "https://[::1]/x"},
+		{"", "", "[::1]", "/x", http.StatusMovedPermanently, "https://[::1]/x"},
+		{"8443", "", "[::1]:80", "/x", http.StatusMovedPermanently, "https://[::1]:8443/x"},
+		{"", "", "example.com", "/a%2Fb", http.StatusMovedPermanently, "https://example.com/a%2Fb"},
+		{"", "www.example.com", "example.com", "/x", http.StatusMovedPermanently, "https://www.example.com/x"},
+		{"8443", "::1", "example.com", "/x", http.StatusMovedPermanently, "https://[::1]:8443/x"},
+		{"", "", "", "/x", http.StatusBadRequest, ""},
+	}
+
+	defer func(host string) { RedirectHost = host }(RedirectHost)
+	for _, tt := range tests {
+		RedirectHost = tt.redirectHost
+		r := httptest.NewRequest("GET", tt.target, nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		redirectHandler(tt.port).ServeHTTP(w, r)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("port %q, host %q, %s: status %d, want %d", tt.port, tt.host, tt.target, w.Code, tt.wantStatus)
+		}
+		if got := w.Header().Get("Location"); got != tt.wantLocation {
+			t.Errorf("port %q, host %q, %s: Location %q, want %q", tt.port, tt.host, tt.target, got, tt.wantLocation)
+		}
+	}
+}
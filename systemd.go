@@ -0,0 +1,298 @@
+package endless
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type activatedSocket struct {
+	file *os.File
+	name string
+	used bool
+}
+
+var (
+	activatedLock    sync.Mutex
+	activatedLoaded  bool
+	activatedSockets []*activatedSocket
+
+	// EnableSdNotify turns on sending status updates to systemd (see
+	// sd_notify(3)) when NOTIFY_SOCKET is set.
+	EnableSdNotify bool
+	watchdogOnce   sync.Once
+)
+
+/*
+loadActivatedSockets picks up the sockets passed by systemd socket activation
+(LISTEN_PID, LISTEN_FDS, LISTEN_FDNAMES). A forked child gets the sockets that
+were not used by its parent in ENDLESS_LISTEN_FDS and ENDLESS_LISTEN_FDNAMES.
+
+The variables are removed from the environment so that they do not end up in
+processes we start. activatedLock must be held.
+*/
+func loadActivatedSockets() {
+	if activatedLoaded {
+		return
+	}
+	activatedLoaded = true
+
+	start, count := 0, 0
+	names := ""
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == syscall.Getpid() {
+		start = 3
+		count, _ = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		names = os.Getenv("LISTEN_FDNAMES")
+	} else if fds := os.Getenv("ENDLESS_LISTEN_FDS"); fds != "" {
+		fmt.Sscanf(fds, "%d:%d", &start, &count)
+		names = os.Getenv("ENDLESS_LISTEN_FDNAMES")
+	}
+
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES",
+		"ENDLESS_LISTEN_FDS", "ENDLESS_LISTEN_FDNAMES"} {
+		os.Unsetenv(key)
+	}
+
+	if start < 3 || count <= 0 {
+		return
+	}
+
+	fdNames := strings.Split(names, ":")
+	for i := 0; i < count; i++ {
+		fd := start + i
+		syscall.CloseOnExec(fd)
+
+		name := ""
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		activatedSockets = append(activatedSockets, &activatedSocket{
+			file: os.NewFile(uintptr(fd), name),
+			name: name,
+		})
+	}
+
+	logEvent(slog.LevelInfo, "socket_activation", "Got activated sockets",
+		"count", count, "names", names)
+}
+
+/*
+activatedListener returns a listener for an activated socket that is named like
+the server (name or laddr) or is bound to laddr. It returns nil if there is no
+such socket.
+*/
+func activatedListener(network, name, laddr string) (l net.Listener, err error) {
+	activatedLock.Lock()
+	defer activatedLock.Unlock()
+
+	loadActivatedSockets()
+	for _, as := range activatedSockets {
+		if as.used {
+			continue
+		}
+
+		l, err = net.FileListener(as.file)
+		if err != nil {
+			// not a listening stream socket
+			l, err = nil, nil
+			continue
+		}
+
+		if as.name == name || as.name == laddr || addrMatches(network, laddr, l.Addr()) {
+			as.used = true
+			logEvent(slog.LevelInfo, "socket_activation", "Using activated socket",
+				"name", as.name, "socket", l.Addr(), "addr", laddr)
+			return
+		}
+		l.Close()
+		l = nil
+	}
+
+	return
+}
+
+/*
+activatedPacketConn is the PacketConn version of activatedListener.
+*/
+func activatedPacketConn(network, name, laddr string) (c net.PacketConn, err error) {
+	activatedLock.Lock()
+	defer activatedLock.Unlock()
+
+	loadActivatedSockets()
+	for _, as := range activatedSockets {
+		if as.used {
+			continue
+		}
+
+		c, err = net.FilePacketConn(as.file)
+		if err != nil {
+			// not a datagram socket
+			c, err = nil, nil
+			continue
+		}
+
+		if as.name == name || as.name == laddr || addrMatches(network, laddr, c.LocalAddr()) {
+			as.used = true
+			logEvent(slog.LevelInfo, "socket_activation", "Using activated socket",
+				"name", as.name, "socket", c.LocalAddr(), "addr", laddr)
+			return
+		}
+		c.Close()
+		c = nil
+	}
+
+	return
+}
+
+/*
+unusedActivatedSockets returns dups of the activated sockets no server uses and
+the environment telling a child started with them as ExtraFiles, beginning at
+fd first, about them.
+*/
+func unusedActivatedSockets(first int) (files []*os.File, env []string) {
+	activatedLock.Lock()
+	defer activatedLock.Unlock()
+
+	loadActivatedSockets()
+	var names []string
+	for _, as := range activatedSockets {
+		if as.used {
+			continue
+		}
+
+		fd, err := syscall.Dup(int(as.file.Fd()))
+		if err != nil {
+			logEvent(slog.LevelError, "socket_activation", "Failed to dup activated socket",
+				"name", as.name, "error", err)
+			continue
+		}
+		files = append(files, os.NewFile(uintptr(fd), as.name))
+		names = append(names, as.name)
+	}
+
+	if len(files) > 0 {
+		env = []string{
+			fmt.Sprintf("ENDLESS_LISTEN_FDS=%d:%d", first, len(files)),
+			"ENDLESS_LISTEN_FDNAMES=" + strings.Join(names, ":"),
+		}
+	}
+
+	return
+}
+
+/*
+addrMatches tells whether a socket bound to got serves the address want. The
+ports have to match. An empty host in want or a socket bound to all addresses
+matches any IP, otherwise a hostname matches the IPs it resolves to.
+*/
+func addrMatches(network, want string, got net.Addr) bool {
+	if !strings.HasPrefix(network, got.Network()) {
+		return false
+	}
+
+	if got.Network() == "unix" || got.Network() == "unixgram" {
+		return want == got.String()
+	}
+
+	host, port, err := net.SplitHostPort(want)
+	if err != nil {
+		return false
+	}
+	gotHost, gotPort, err := net.SplitHostPort(got.String())
+	if err != nil {
+		return false
+	}
+
+	wantPort, err := net.LookupPort(got.Network(), port)
+	if err != nil || strconv.Itoa(wantPort) != gotPort {
+		return false
+	}
+
+	gotIP := net.ParseIP(gotHost)
+	if host == "" || gotIP.IsUnspecified() {
+		// systemd decides on which addresses to listen
+		return true
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(gotIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+sdNotify sends state to systemd if EnableSdNotify is set and we run under a
+Type=notify unit. Because restarting forks a new main process the unit needs
+NotifyAccess=all.
+
+The first READY=1 starts the watchdog pings if WATCHDOG_USEC is set.
+*/
+func sdNotify(state string) {
+	if !EnableSdNotify {
+		return
+	}
+
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		logEvent(slog.LevelError, "sd_notify", "sd_notify error", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		logEvent(slog.LevelError, "sd_notify", "sd_notify error", "error", err)
+		return
+	}
+
+	if strings.Contains(state, "READY=1") {
+		watchdogOnce.Do(startWatchdog)
+	}
+}
+
+/*
+startWatchdog sends WATCHDOG=1 at half the interval systemd asked for in
+WATCHDOG_USEC.
+
+WATCHDOG_PID is removed from the environment: after a restart the child is the
+main process and has to send the pings.
+*/
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+
+	pid := os.Getenv("WATCHDOG_PID")
+	os.Unsetenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(syscall.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	logEvent(slog.LevelInfo, "watchdog", "Sending watchdog pings", "interval", interval)
+
+	go func() {
+		for range time.Tick(interval) {
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
@@ -0,0 +1,58 @@
+package endless
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "")
+	defer func(enabled bool) { EnableSdNotify = enabled }(EnableSdNotify)
+
+	mainPid := fmt.Sprintf("MAINPID=%d\nREADY=1", syscall.Getpid())
+	tests := []struct {
+		enabled bool
+		state   string
+		want    string
+	}{
+		{true, "READY=1", "READY=1"},
+		{true, "RELOADING=1", "RELOADING=1"},
+		{true, "STOPPING=1", "STOPPING=1"},
+		{true, mainPid, mainPid},
+		{false, "READY=1", ""},
+	}
+
+	buf := make([]byte, 1024)
+	for _, tt := range tests {
+		EnableSdNotify = tt.enabled
+		sdNotify(tt.state)
+
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("sdNotify(%q) with EnableSdNotify off sent %q", tt.state, buf[:n])
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("sdNotify(%q): %v", tt.state, err)
+			continue
+		}
+		if got := string(buf[:n]); got != tt.want {
+			t.Errorf("sdNotify(%q) sent %q, want %q", tt.state, got, tt.want)
+		}
+	}
+}
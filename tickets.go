@@ -0,0 +1,146 @@
+package endless
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// how many ticket keys are kept. the newest one encrypts new tickets, the
+// older ones still decrypt tickets handed out before the last rotations
+const ticketKeyCount = 3
+
+var (
+	// session ticket keys of all TLS servers, newest first. they are passed
+	// on to the child, so clients can resume their sessions after a restart
+	ticketKeysLock    sync.Mutex
+	ticketKeys        [][32]byte
+	ticketKeysRotated time.Time
+	ticketConfigs     []*tls.Config
+	ticketRotateOnce  sync.Once
+)
+
+/*
+installTicketKeys makes config, of a server serving certificate files, use the
+shared session ticket keys and keeps it up to date when they are rotated.
+Nothing is done if DefaultTicketKeyRotation is negative, config has session
+tickets disabled or handles them itself (SessionTicketKey, WrapSession or
+UnwrapSession). Keys set with SetSessionTicketKeys can't be told apart from
+the ones crypto/tls makes up, they are replaced.
+*/
+func installTicketKeys(config *tls.Config) {
+	if DefaultTicketKeyRotation < 0 || config.SessionTicketsDisabled {
+		return
+	}
+	if config.SessionTicketKey != [32]byte{} || config.WrapSession != nil || config.UnwrapSession != nil {
+		return
+	}
+
+	ticketKeysLock.Lock()
+	defer ticketKeysLock.Unlock()
+
+	if len(ticketKeys) == 0 {
+		key, err := newTicketKey()
+		if err != nil {
+			logEvent(slog.LevelError, "ticket_keys_error", "Failed to create session ticket key", "error", err)
+			return
+		}
+		ticketKeys = [][32]byte{key}
+		ticketKeysRotated = time.Now()
+	}
+	config.SetSessionTicketKeys(ticketKeys)
+	ticketConfigs = append(ticketConfigs, config)
+
+	if DefaultTicketKeyRotation > 0 {
+		ticketRotateOnce.Do(func() { go rotateTicketKeys() })
+	}
+}
+
+func newTicketKey() (key [32]byte, err error) {
+	_, err = rand.Read(key[:])
+	return
+}
+
+/*
+rotateTicketKeys adds a new session ticket key every DefaultTicketKeyRotation
+(counted from when the newest key was made, which may have been by the parent)
+and drops the oldest one.
+*/
+func rotateTicketKeys() {
+	for {
+		ticketKeysLock.Lock()
+		next := ticketKeysRotated.Add(DefaultTicketKeyRotation)
+		ticketKeysLock.Unlock()
+
+		time.Sleep(time.Until(next))
+
+		key, err := newTicketKey()
+		if err != nil {
+			logEvent(slog.LevelError, "ticket_keys_error", "Failed to create session ticket key", "error", err)
+			// try again next time
+			ticketKeysLock.Lock()
+			ticketKeysRotated = time.Now()
+			ticketKeysLock.Unlock()
+			continue
+		}
+
+		ticketKeysLock.Lock()
+		ticketKeys = append([][32]byte{key}, ticketKeys...)
+		if len(ticketKeys) > ticketKeyCount {
+			ticketKeys = ticketKeys[:ticketKeyCount]
+		}
+		ticketKeysRotated = time.Now()
+		for _, config := range ticketConfigs {
+			config.SetSessionTicketKeys(ticketKeys)
+		}
+		ticketKeysLock.Unlock()
+
+		logEvent(slog.LevelInfo, "ticket_keys_rotated", "Rotated session ticket keys")
+	}
+}
+
+/*
+handOverTicketKeys puts the session ticket keys into the manifest for the child.
+*/
+func handOverTicketKeys(m *handoffManifest) {
+	ticketKeysLock.Lock()
+	defer ticketKeysLock.Unlock()
+
+	if len(ticketKeys) == 0 {
+		return
+	}
+	for _, key := range ticketKeys {
+		m.TicketKeys = append(m.TicketKeys, append([]byte(nil), key[:]...))
+	}
+	m.TicketKeysRotated = ticketKeysRotated.UnixNano()
+}
+
+/*
+takeOverTicketKeys uses the session ticket keys the parent passed in the
+manifest.
+*/
+func takeOverTicketKeys(m *handoffManifest) {
+	var keys [][32]byte
+	for _, b := range m.TicketKeys {
+		var key [32]byte
+		if len(b) != len(key) {
+			logEvent(slog.LevelError, "ticket_keys_error", "Ignoring session ticket keys of invalid length",
+				"length", len(b))
+			return
+		}
+		copy(key[:], b)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	ticketKeysLock.Lock()
+	ticketKeys = keys
+	ticketKeysRotated = time.Unix(0, m.TicketKeysRotated)
+	ticketKeysLock.Unlock()
+
+	logEvent(slog.LevelInfo, "ticket_keys", "Took over session ticket keys", "count", len(keys))
+}
@@ -0,0 +1,123 @@
+package endless
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+/*
+NewUnixServer returns an intialized endlessServer Object that listens on the
+unix domain socket at path. The socket file gets the permissions mode, its owner
+can be changed by setting SocketUid and SocketGid before starting the server.
+*/
+func NewUnixServer(path string, mode os.FileMode, handler http.Handler) (srv *endlessServer) {
+	srv = newServer("unix", "", path, handler)
+	srv.SocketMode = mode
+	return
+}
+
+/*
+ListenAndServeUnix acts identically to ListenAndServe, except that it listens
+on the unix domain socket at path. The socket is handed over to the child on
+restarts and the socket file is only removed when the last generation shuts
+down.
+*/
+func ListenAndServeUnix(path string, mode os.FileMode, handler http.Handler) error {
+	server := NewUnixServer(path, mode, handler)
+	return server.ListenAndServe()
+}
+
+/*
+listenUnix creates the unix domain socket at path, replacing a stale socket file
+left behind by a crashed process.
+*/
+func (srv *endlessServer) listenUnix(path string) (l net.Listener, err error) {
+	err = removeStaleSocket(path)
+	if err != nil {
+		return
+	}
+
+	var lc net.ListenConfig
+	if srv.SocketMode != 0 {
+		// bind creates the socket file with the mode of the socket minus the
+		// umask. setting it first keeps others from connecting before the
+		// chmod below. where sockets have no mode of their own the chmod
+		// has to do.
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				syscall.Fchmod(int(fd), uint32(srv.SocketMode.Perm()))
+			})
+		}
+	}
+	l, err = lc.Listen(context.Background(), "unix", path)
+	if err != nil {
+		err = fmt.Errorf("net.Listen error: %v", err)
+		return
+	}
+	// children inherit the socket, they decide when the file goes away
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if srv.SocketMode != 0 {
+		err = os.Chmod(path, srv.SocketMode)
+		if err != nil {
+			l.Close()
+			err = fmt.Errorf("chmod unix socket error: %v", err)
+			return
+		}
+	}
+
+	if srv.SocketUid != -1 || srv.SocketGid != -1 {
+		err = os.Chown(path, srv.SocketUid, srv.SocketGid)
+		if err != nil {
+			l.Close()
+			err = fmt.Errorf("chown unix socket error: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+/*
+removeStaleSocket removes the socket file at path if no one is listening on it.
+*/
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+
+	logEvent(slog.LevelWarn, "stale_socket", "Removing stale unix socket", "path", path)
+	return os.Remove(path)
+}
+
+/*
+unlinkUnixSocket removes the socket file of srv unless a forked child is taking
+over the socket or the socket belongs to systemd.
+*/
+func (srv *endlessServer) unlinkUnixSocket() {
+	if handedOver() || srv.socketActivated {
+		// the child or systemd still need the file
+		return
+	}
+
+	err := os.Remove(srv.Addr)
+	if err != nil && !os.IsNotExist(err) {
+		srv.logEvent(slog.LevelError, "unlink", "Failed to remove unix socket", "error", err)
+	}
+}